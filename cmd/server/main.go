@@ -9,11 +9,20 @@ import (
 	"syscall"
 	"time"
 
-	"skytalk/internal/auth"
-	"skytalk/internal/config"
-	"skytalk/internal/db"
-	"skytalk/internal/router"
-	"skytalk/internal/websocket"
+	"messenger/internal/auth"
+	"messenger/internal/broker"
+	"messenger/internal/call"
+	"messenger/internal/config"
+	"messenger/internal/contact"
+	"messenger/internal/db"
+	"messenger/internal/mail"
+	"messenger/internal/media"
+	"messenger/internal/quota"
+	"messenger/internal/receipt"
+	"messenger/internal/router"
+	"messenger/internal/storage"
+	"messenger/internal/upload"
+	"messenger/internal/websocket"
 )
 
 func main() {
@@ -35,15 +44,71 @@ func main() {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
+	// Account emails; the log mailer only prints them
+	var mailer mail.Mailer
+	switch cfg.Mail.Driver {
+	case "smtp":
+		mailer = mail.NewSMTPMailer(&cfg.Mail)
+	default:
+		mailer = mail.NewLogMailer(100)
+	}
+
 	// Initialize services
-	authService := auth.NewService(database.DB, &cfg.JWT)
+	authService := auth.NewService(database.DB, &cfg.JWT, mailer, &cfg.Mail)
+	go authService.RunCleanup(time.Hour)
 	
+	// Initialize file storage
+	var fileStorage storage.Storage
+	switch cfg.File.Storage {
+	case "s3":
+		fileStorage, err = storage.NewS3Storage(&cfg.S3)
+	default:
+		fileStorage, err = storage.NewLocalStorage(cfg.File.UploadPath)
+	}
+	if err != nil {
+		log.Fatal("Failed to initialize file storage:", err)
+	}
+
+	// Resumable upload sessions, swept hourly once they expire
+	uploadSessions, err := upload.NewManager(database.DB, &cfg.File)
+	if err != nil {
+		log.Fatal("Failed to initialize upload sessions:", err)
+	}
+	go uploadSessions.RunCleanup(time.Hour)
+
+	// Initialize event broker shared by all server instances
+	var eventBroker broker.Broker = broker.NewMemoryBroker()
+	if cfg.Redis.PubSubEnabled {
+		eventBroker = broker.NewRedisBroker(&cfg.Redis)
+	}
+	defer eventBroker.Close()
+
 	// Initialize WebSocket hub
-	hub := websocket.NewHub(database.DB)
+	hub := websocket.NewHub(database.DB, eventBroker)
+
+	// Delivery and read receipts are recorded by the hub as well as the API
+	receiptService := receipt.NewService(database.DB, hub)
+	hub.SetReceiptTracker(receiptService)
+
+	// Contacts and blocks; blocks are also checked by messages, calls and search
+	contactService := contact.NewService(database.DB, hub, &cfg.Contact)
+
+	// Calls; unanswered ones are marked missed after the ring timeout. The
+	// hub routes call signaling to the participants.
+	callService := call.NewService(database.DB, hub, contactService, &cfg.Call)
+	hub.SetCallRegistry(callService)
 	go hub.Run()
+	go callService.RunTimeouts(5 * time.Second)
+
+	// Thumbnails and media metadata are generated in the background
+	mediaProcessor := media.NewProcessor(database.DB, fileStorage, hub, &cfg.File)
+	go mediaProcessor.Run()
+
+	// Storage quotas per uploader and per chat
+	quotaService := quota.NewService(database.DB, &cfg.File)
 
 	// Setup router
-	r := router.Setup(authService, hub, cfg, database)
+	r := router.Setup(authService, receiptService, contactService, callService, quotaService, fileStorage, uploadSessions, mediaProcessor, hub, cfg, database)
 
 	// Start server
 	server := &http.Server{
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+	"messenger/internal/mail"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid or expired token")
+	ErrEmailVerified   = errors.New("email is already verified")
+	ErrWrongPassword   = errors.New("current password is incorrect")
+	ErrTooManyRequests = errors.New("an email was sent recently, try again later")
+)
+
+// resendInterval is how long a user waits between two emails of one kind
+const resendInterval = time.Minute
+
+// mailTimeout bounds the delivery of one email
+const mailTimeout = 30 * time.Second
+
+// SendVerification emails the user a link that confirms their address. Any
+// earlier link stops working.
+func (s *Service) SendVerification(userID uuid.UUID) error {
+	var user models.User
+	if err := s.db.Where("id = ? AND is_active = ?", userID, true).First(&user).Error; err != nil {
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailVerified
+	}
+
+	token, err := s.createToken(user, models.TokenPurposeVerifyEmail, s.verificationTTL)
+	if err != nil {
+		return err
+	}
+
+	s.send(mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Hi %s,\n\nconfirm your email address by opening this link:\n\n%s\n\nThe link expires in %s. If you did not sign up, ignore this email.\n",
+			user.Username, s.link("verify_token", token), formatTTL(s.verificationTTL)),
+	})
+	return nil
+}
+
+// VerifyEmail marks the address a verification token was sent to as
+// confirmed, provided it is still the user's address
+func (s *Service) VerifyEmail(token string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		record, err := consumeToken(tx, models.TokenPurposeVerifyEmail, token)
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND email = ? AND is_active = ?", record.UserID, record.Email, true).
+			Update("email_verified_at", time.Now())
+		if result.Error != nil {
+			return fmt.Errorf("failed to verify email: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidToken
+		}
+		return nil
+	})
+}
+
+// RequestPasswordReset emails a reset link to the account with this
+// address. Unknown addresses and repeated requests are ignored without an
+// error, so the answer does not reveal who has an account.
+func (s *Service) RequestPasswordReset(email string) error {
+	var user models.User
+	err := s.db.Where("lower(email) = lower(?) AND is_active = ?", email, true).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+
+	token, err := s.createToken(user, models.TokenPurposeResetPassword, s.resetTTL)
+	if err != nil {
+		if errors.Is(err, ErrTooManyRequests) {
+			return nil
+		}
+		return err
+	}
+
+	s.send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nset a new password by opening this link:\n\n%s\n\nThe link expires in %s and works once. If you did not ask for a reset, ignore this email; your password stays the same.\n",
+			user.Username, s.link("reset_token", token), formatTTL(s.resetTTL)),
+	})
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token and signs the user
+// out everywhere. It returns the user and the sessions it revoked. Opening
+// the link proves the address, so it also counts as verification.
+func (s *Service) ResetPassword(token, password string) (uuid.UUID, []uuid.UUID, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return uuid.Nil, nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	var userID uuid.UUID
+	var revoked []uuid.UUID
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		record, err := consumeToken(tx, models.TokenPurposeResetPassword, token)
+		if err != nil {
+			return err
+		}
+
+		var user models.User
+		err = tx.Where("id = ? AND email = ? AND is_active = ?", record.UserID, record.Email, true).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidToken
+			}
+			return fmt.Errorf("failed to find user: %w", err)
+		}
+
+		updates := map[string]interface{}{"password": string(hashedPassword)}
+		if user.EmailVerifiedAt == nil {
+			updates["email_verified_at"] = time.Now()
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to update password: %w", err)
+		}
+
+		userID = user.ID
+		revoked, err = revokeSessions(tx, user.ID, uuid.Nil)
+		return err
+	})
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	return userID, revoked, nil
+}
+
+// ChangePassword replaces the password of a signed-in user after checking
+// the current one, and signs out every other session. It returns the
+// sessions it revoked.
+func (s *Service) ChangePassword(userID, sessionID uuid.UUID, currentPassword, newPassword string) ([]uuid.UUID, error) {
+	var user models.User
+	if err := s.db.Where("id = ? AND is_active = ?", userID, true).First(&user).Error; err != nil {
+		return nil, fmt.Errorf("failed to find user: %w", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+		return nil, ErrWrongPassword
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	var revoked []uuid.UUID
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("password", string(hashedPassword)).Error; err != nil {
+			return fmt.Errorf("failed to update password: %w", err)
+		}
+
+		// Reset links sent before the change must not undo it
+		err := tx.Model(&models.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, models.TokenPurposeResetPassword).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			return fmt.Errorf("failed to invalidate reset tokens: %w", err)
+		}
+
+		revoked, err = revokeSessions(tx, userID, sessionID)
+		return err
+	})
+	return revoked, err
+}
+
+// createToken stores a new token for purpose and invalidates the ones sent
+// before it. The user row is locked so concurrent requests cannot both pass
+// the resend check.
+func (s *Service) createToken(user models.User, purpose models.TokenPurpose, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.User{}, "id = ?", user.ID).Error; err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		now := time.Now()
+		var recent int64
+		err := tx.Model(&models.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, purpose, now.Add(-resendInterval)).
+			Count(&recent).Error
+		if err != nil {
+			return fmt.Errorf("failed to check tokens: %w", err)
+		}
+		if recent > 0 {
+			return ErrTooManyRequests
+		}
+
+		err = tx.Model(&models.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).
+			Update("used_at", now).Error
+		if err != nil {
+			return fmt.Errorf("failed to invalidate tokens: %w", err)
+		}
+
+		record := models.UserToken{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			Token:     hashToken(token),
+			Email:     user.Email,
+			ExpiresAt: now.Add(ttl),
+		}
+		if err := tx.Create(&record).Error; err != nil {
+			return fmt.Errorf("failed to create token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeToken uses up a live token of purpose
+func consumeToken(tx *gorm.DB, purpose models.TokenPurpose, token string) (*models.UserToken, error) {
+	var record models.UserToken
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token = ? AND purpose = ?", hashToken(token), purpose).
+		First(&record).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("failed to find token: %w", err)
+	}
+
+	now := time.Now()
+	if record.UsedAt != nil || !record.ExpiresAt.After(now) {
+		return nil, ErrInvalidToken
+	}
+
+	if err := tx.Model(&record).Update("used_at", now).Error; err != nil {
+		return nil, fmt.Errorf("failed to use token: %w", err)
+	}
+	return &record, nil
+}
+
+// link builds the web client address an emailed token opens
+func (s *Service) link(param, token string) string {
+	return s.appURL + "/?" + url.Values{param: {token}}.Encode()
+}
+
+// formatTTL spells out a link lifetime for an email
+func formatTTL(ttl time.Duration) string {
+	if ttl >= time.Hour && ttl%time.Hour == 0 {
+		return fmt.Sprintf("%d hours", int(ttl.Hours()))
+	}
+	return fmt.Sprintf("%d minutes", int(ttl.Minutes()))
+}
+
+// send delivers an email in the background; a request never waits for the
+// mail server, and failures are only logged
+func (s *Service) send(message mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+
+		if err := s.mailer.Send(ctx, message); err != nil {
+			log.Printf("Failed to send %q to %s: %v", message.Subject, message.To, err)
+		}
+	}()
+}
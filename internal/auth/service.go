@@ -1,33 +1,59 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"time"
 	"messenger/pkg/models"
 	"messenger/internal/config"
+	"messenger/internal/mail"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// Service issues short-lived access tokens and rotating refresh tokens.
+// Access tokens are self-contained JWTs checked without the database, so a
+// revoked session keeps working until its access token expires. Refresh
+// tokens are opaque, stored hashed, and can each be used once. Email
+// verification and password reset links go out through mailer.
 type Service struct {
-	db        *gorm.DB
-	jwtSecret string
-	jwtExpiry int
+	db         *gorm.DB
+	jwtSecret  string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+
+	mailer          mail.Mailer
+	appURL          string
+	verificationTTL time.Duration
+	resetTTL        time.Duration
 }
 
 type Claims struct {
-	UserID   uuid.UUID `json:"user_id"`
-	Username string    `json:"username"`
-	Email    string    `json:"email"`
+	UserID uuid.UUID `json:"user_id"`
+	// SessionID is the refresh token family the access token was issued to
+	SessionID uuid.UUID `json:"sid"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
 	jwt.RegisteredClaims
 }
 
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	Device
 }
 
 type RegisterRequest struct {
@@ -36,22 +62,36 @@ type RegisterRequest struct {
 	Password  string `json:"password" binding:"required,min=6"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
+	Device
+}
+
+// TokenPair is what a client needs to stay signed in. ExpiresAt is when the
+// access token runs out and has to be refreshed.
+type TokenPair struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
 }
 
 type AuthResponse struct {
-	User  models.User `json:"user"`
-	Token string      `json:"token"`
+	User models.User `json:"user"`
+	TokenPair
 }
 
-func NewService(db *gorm.DB, jwtConfig *config.JWTConfig) *Service {
+func NewService(db *gorm.DB, jwtConfig *config.JWTConfig, mailer mail.Mailer, mailConfig *config.MailConfig) *Service {
 	return &Service{
-		db:        db,
-		jwtSecret: jwtConfig.Secret,
-		jwtExpiry: jwtConfig.ExpiresIn,
+		db:              db,
+		jwtSecret:       jwtConfig.Secret,
+		accessTTL:       time.Duration(jwtConfig.AccessTTL) * time.Minute,
+		refreshTTL:      time.Duration(jwtConfig.RefreshTTL) * time.Hour,
+		mailer:          mailer,
+		appURL:          mailConfig.AppURL,
+		verificationTTL: time.Duration(mailConfig.VerificationTTL) * time.Hour,
+		resetTTL:        time.Duration(mailConfig.ResetTTL) * time.Minute,
 	}
 }
 
-func (s *Service) Register(req RegisterRequest) (*AuthResponse, error) {
+func (s *Service) Register(req RegisterRequest, ip string) (*AuthResponse, error) {
 	// Check if user already exists
 	var existingUser models.User
 	if err := s.db.Where("username = ? OR email = ?", req.Username, req.Email).First(&existingUser).Error; err == nil {
@@ -79,33 +119,27 @@ func (s *Service) Register(req RegisterRequest) (*AuthResponse, error) {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	// Generate JWT token
-	token, err := s.generateToken(user)
+	// Start a new session
+	tokens, err := s.issueTokens(s.db, user, req.Device.session(uuid.New(), ip))
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %w", err)
+		return nil, err
 	}
 
-	// Create user session
-	session := models.UserSession{
-		UserID:    user.ID,
-		Token:     token,
-		ExpiresAt: time.Now().Add(time.Duration(s.jwtExpiry) * time.Hour),
-	}
-
-	if err := s.db.Create(&session).Error; err != nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+	// Ask the user to confirm their address; they can sign in meanwhile
+	if err := s.SendVerification(user.ID); err != nil {
+		log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
 	}
 
 	// Clear password from response
 	user.Password = ""
 
 	return &AuthResponse{
-		User:  user,
-		Token: token,
+		User:      user,
+		TokenPair: *tokens,
 	}, nil
 }
 
-func (s *Service) Login(req LoginRequest) (*AuthResponse, error) {
+func (s *Service) Login(req LoginRequest, ip string) (*AuthResponse, error) {
 	var user models.User
 	if err := s.db.Where("username = ? OR email = ?", req.Username, req.Username).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -124,12 +158,6 @@ func (s *Service) Login(req LoginRequest) (*AuthResponse, error) {
 		return nil, errors.New("invalid credentials")
 	}
 
-	// Generate JWT token
-	token, err := s.generateToken(user)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %w", err)
-	}
-
 	// Update user status and last seen
 	now := time.Now()
 	user.Status = models.StatusOnline
@@ -138,27 +166,99 @@ func (s *Service) Login(req LoginRequest) (*AuthResponse, error) {
 		return nil, fmt.Errorf("failed to update user status: %w", err)
 	}
 
-	// Create user session
-	session := models.UserSession{
-		UserID:    user.ID,
-		Token:     token,
-		ExpiresAt: time.Now().Add(time.Duration(s.jwtExpiry) * time.Hour),
-	}
-
-	if err := s.db.Create(&session).Error; err != nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+	// Start a new session
+	tokens, err := s.issueTokens(s.db, user, req.Device.session(uuid.New(), ip))
+	if err != nil {
+		return nil, err
 	}
 
 	// Clear password from response
 	user.Password = ""
 
 	return &AuthResponse{
-		User:  user,
-		Token: token,
+		User:      user,
+		TokenPair: *tokens,
 	}, nil
 }
 
-func (s *Service) Logout(userID uuid.UUID, token string) error {
+// Refresh trades a refresh token for a new pair from the same family. A
+// token that was already used means it leaked, so the whole family is
+// revoked, a *ReuseError naming it is returned and the client has to sign
+// in again.
+func (s *Service) Refresh(refreshToken, ip string) (*TokenPair, error) {
+	var tokens *TokenPair
+	var reused *models.UserSession
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var session models.UserSession
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token = ?", hashToken(refreshToken)).
+			First(&session).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return fmt.Errorf("failed to find session: %w", err)
+		}
+
+		now := time.Now()
+		if session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+			return ErrInvalidRefreshToken
+		}
+		if session.UsedAt != nil {
+			reused = &session
+			return revokeFamily(tx, session.FamilyID)
+		}
+
+		var user models.User
+		if err := tx.Where("id = ? AND is_active = ?", session.UserID, true).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return fmt.Errorf("failed to find user: %w", err)
+		}
+
+		if err := tx.Model(&session).Update("used_at", now).Error; err != nil {
+			return fmt.Errorf("failed to rotate session: %w", err)
+		}
+
+		next := models.UserSession{
+			FamilyID:   session.FamilyID,
+			DeviceName: session.DeviceName,
+			ClientType: session.ClientType,
+			IP:         ip,
+		}
+		tokens, err = s.issueTokens(tx, user, next)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reused != nil {
+		log.Printf("Refresh token reuse for user %s, session %s revoked", reused.UserID, reused.FamilyID)
+		return nil, &ReuseError{UserID: reused.UserID, SessionID: reused.FamilyID}
+	}
+	return tokens, nil
+}
+
+// RunCleanup deletes expired refresh tokens and email tokens every interval
+func (s *Service) RunCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.db.Where("expires_at < ?", time.Now()).Delete(&models.UserSession{}).Error; err != nil {
+			log.Printf("Failed to delete expired sessions: %v", err)
+		}
+		if err := s.db.Where("expires_at < ?", time.Now()).Delete(&models.UserToken{}).Error; err != nil {
+			log.Printf("Failed to delete expired email tokens: %v", err)
+		}
+	}
+}
+
+// Logout ends the session an access token belongs to. The access token
+// itself stays valid until it expires.
+func (s *Service) Logout(userID, sessionID uuid.UUID) error {
 	// Update user status to offline
 	now := time.Now()
 	if err := s.db.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
@@ -168,9 +268,9 @@ func (s *Service) Logout(userID uuid.UUID, token string) error {
 		return fmt.Errorf("failed to update user status: %w", err)
 	}
 
-	// Delete session
-	if err := s.db.Where("user_id = ? AND token = ?", userID, token).Delete(&models.UserSession{}).Error; err != nil {
-		return fmt.Errorf("failed to delete session: %w", err)
+	// Revoke the session
+	if err := revokeFamily(s.db.Where("user_id = ?", userID), sessionID); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
 	}
 
 	return nil
@@ -179,7 +279,7 @@ func (s *Service) Logout(userID uuid.UUID, token string) error {
 func (s *Service) ValidateToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(s.jwtSecret), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, fmt.Errorf("invalid token: %w", err)
@@ -194,25 +294,52 @@ func (s *Service) ValidateToken(tokenString string) (*Claims, error) {
 		return nil, errors.New("invalid token claims")
 	}
 
-	// Check if session exists
-	var session models.UserSession
-	if err := s.db.Where("user_id = ? AND token = ? AND expires_at > ?", claims.UserID, tokenString, time.Now()).First(&session).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("session not found or expired")
-		}
-		return nil, fmt.Errorf("failed to find session: %w", err)
+	// Tokens without an expiry would never have to be refreshed
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
 	}
 
 	return claims, nil
 }
 
-func (s *Service) generateToken(user models.User) (string, error) {
+// issueTokens stores the next refresh token of session's family, with the
+// device details of session, and signs an access token that points at it
+func (s *Service) issueTokens(tx *gorm.DB, user models.User, session models.UserSession) (*TokenPair, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	now := time.Now()
+	session.UserID = user.ID
+	session.Token = hashToken(refreshToken)
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(s.refreshTTL)
+	if err := tx.Create(&session).Error; err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	expiresAt := now.Add(s.accessTTL)
+	token, err := s.generateToken(user, session.FamilyID, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	return &TokenPair{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+func (s *Service) generateToken(user models.User, sessionID uuid.UUID, expiresAt time.Time) (string, error) {
 	claims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Email:    user.Email,
+		UserID:    user.ID,
+		SessionID: sessionID,
+		Username:  user.Username,
+		Email:     user.Email,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(s.jwtExpiry) * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   user.ID.String(),
 		},
@@ -220,4 +347,24 @@ func (s *Service) generateToken(user models.User) (string, error) {
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(s.jwtSecret))
-}
\ No newline at end of file
+}
+
+// revokeFamily revokes every token of a session that is not revoked yet
+func revokeFamily(tx *gorm.DB, familyID uuid.UUID) error {
+	return tx.Model(&models.UserSession{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"messenger/internal/config"
+	"messenger/internal/mail"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The tests run against the Postgres database in TEST_DATABASE_URL, e.g.
+// "host=localhost user=postgres password=password dbname=messenger_test
+// sslmode=disable", and are skipped without one. Every test signs up its own
+// users, so they can share a database.
+func newTestService(t *testing.T) (*Service, *mail.LogMailer) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.UserSession{}, &models.UserToken{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	mailer := mail.NewLogMailer(0)
+	service := NewService(db,
+		&config.JWTConfig{Secret: "test-secret", AccessTTL: 15, RefreshTTL: 24},
+		mailer,
+		&config.MailConfig{AppURL: "http://messenger.test", VerificationTTL: 48, ResetTTL: 30},
+	)
+	return service, mailer
+}
+
+// register signs up a new user and returns them with their first session
+func register(t *testing.T, s *Service) (*AuthResponse, uuid.UUID) {
+	t.Helper()
+
+	name := "user_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+	response, err := s.Register(RegisterRequest{
+		Username: name,
+		Email:    name + "@example.com",
+		Password: "old-password",
+	}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	return response, sessionOf(t, s, response.TokenPair)
+}
+
+func login(t *testing.T, s *Service, username, password string) (*TokenPair, uuid.UUID) {
+	t.Helper()
+
+	response, err := s.Login(LoginRequest{Username: username, Password: password}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	return &response.TokenPair, sessionOf(t, s, response.TokenPair)
+}
+
+func sessionOf(t *testing.T, s *Service, tokens TokenPair) uuid.UUID {
+	t.Helper()
+
+	claims, err := s.ValidateToken(tokens.Token)
+	if err != nil {
+		t.Fatalf("validate access token: %v", err)
+	}
+	return claims.SessionID
+}
+
+func expectActive(t *testing.T, s *Service, sessionID uuid.UUID, want bool) {
+	t.Helper()
+
+	active, err := s.SessionActive(sessionID)
+	if err != nil {
+		t.Fatalf("session active: %v", err)
+	}
+	if active != want {
+		t.Fatalf("session %s active = %v, want %v", sessionID, active, want)
+	}
+}
+
+// waitForMail returns the newest email with subject to an address. Emails
+// go out in the background, so they may arrive in any order.
+func waitForMail(t *testing.T, mailer *mail.LogMailer, to, subject string) mail.Message {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		messages := mailer.Messages()
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].To == to && messages[i].Subject == subject {
+				return messages[i]
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %q email to %s", subject, to)
+	return mail.Message{}
+}
+
+// linkToken extracts the token param of the link in an email body
+func linkToken(t *testing.T, body, param string) string {
+	t.Helper()
+
+	for _, field := range strings.Fields(body) {
+		link, err := url.Parse(field)
+		if err != nil || link.Scheme == "" {
+			continue
+		}
+		if token := link.Query().Get(param); token != "" {
+			return token
+		}
+	}
+	t.Fatalf("no %s link in %q", param, body)
+	return ""
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	s, _ := newTestService(t)
+	user, sessionID := register(t, s)
+
+	next, err := s.Refresh(user.RefreshToken, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if next.RefreshToken == user.RefreshToken {
+		t.Fatal("refresh returned the same refresh token")
+	}
+	if got := sessionOf(t, s, *next); got != sessionID {
+		t.Fatalf("refreshed token belongs to session %s, want %s", got, sessionID)
+	}
+
+	if _, err := s.Refresh(next.RefreshToken, "127.0.0.1"); err != nil {
+		t.Fatalf("refresh with the rotated token: %v", err)
+	}
+	if _, err := s.Refresh("not-a-token", "127.0.0.1"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("refresh with an unknown token: got %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	s, _ := newTestService(t)
+	user, sessionID := register(t, s)
+	other, otherID := login(t, s, user.User.Username, "old-password")
+
+	next, err := s.Refresh(user.RefreshToken, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	// Presenting the used token again means it leaked
+	_, err = s.Refresh(user.RefreshToken, "127.0.0.1")
+	var reuse *ReuseError
+	if !errors.As(err, &reuse) {
+		t.Fatalf("reused token: got %v, want *ReuseError", err)
+	}
+	if reuse.UserID != user.User.ID || reuse.SessionID != sessionID {
+		t.Fatalf("reuse error names user %s session %s, want %s %s", reuse.UserID, reuse.SessionID, user.User.ID, sessionID)
+	}
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reuse error does not match ErrRefreshTokenReused: %v", err)
+	}
+
+	// The whole family is gone, including the token handed out legitimately
+	expectActive(t, s, sessionID, false)
+	if _, err := s.Refresh(next.RefreshToken, "127.0.0.1"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("refresh after reuse: got %v, want ErrInvalidRefreshToken", err)
+	}
+
+	// Other devices of the user stay signed in
+	expectActive(t, s, otherID, true)
+	if _, err := s.Refresh(other.RefreshToken, "127.0.0.1"); err != nil {
+		t.Fatalf("refresh on another device: %v", err)
+	}
+}
+
+func TestResetTokenWorksOnce(t *testing.T) {
+	s, mailer := newTestService(t)
+	user, sessionID := register(t, s)
+
+	if err := s.RequestPasswordReset(strings.ToUpper(user.User.Email)); err != nil {
+		t.Fatalf("request reset: %v", err)
+	}
+	token := linkToken(t, waitForMail(t, mailer, user.User.Email, "Reset your password").Body, "reset_token")
+
+	userID, revoked, err := s.ResetPassword(token, "new-password")
+	if err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if userID != user.User.ID {
+		t.Fatalf("reset user %s, want %s", userID, user.User.ID)
+	}
+	if len(revoked) != 1 || revoked[0] != sessionID {
+		t.Fatalf("reset revoked %v, want [%s]", revoked, sessionID)
+	}
+	expectActive(t, s, sessionID, false)
+
+	if _, _, err := s.ResetPassword(token, "another-password"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("second reset with the same token: got %v, want ErrInvalidToken", err)
+	}
+	login(t, s, user.User.Username, "new-password")
+}
+
+func TestResetTokenRejected(t *testing.T) {
+	s, mailer := newTestService(t)
+	user, _ := register(t, s)
+	verify := linkToken(t, waitForMail(t, mailer, user.User.Email, "Confirm your email").Body, "verify_token")
+
+	var record models.User
+	if err := s.db.First(&record, "id = ?", user.User.ID).Error; err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	expired, err := s.createToken(record, models.TokenPurposeResetPassword, -time.Minute)
+	if err != nil {
+		t.Fatalf("create reset token: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", expired},
+		{"unknown", "not-a-token"},
+		{"other purpose", verify},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := s.ResetPassword(tt.token, "new-password"); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+
+	login(t, s, user.User.Username, "old-password")
+}
+
+func TestChangePasswordRevokesOtherSessions(t *testing.T) {
+	s, _ := newTestService(t)
+	user, currentID := register(t, s)
+	_, otherID := login(t, s, user.User.Username, "old-password")
+	third, thirdID := login(t, s, user.User.Username, "old-password")
+
+	if _, err := s.ChangePassword(user.User.ID, currentID, "wrong-password", "new-password"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("change with a wrong password: got %v, want ErrWrongPassword", err)
+	}
+	expectActive(t, s, otherID, true)
+
+	revoked, err := s.ChangePassword(user.User.ID, currentID, "old-password", "new-password")
+	if err != nil {
+		t.Fatalf("change password: %v", err)
+	}
+	if len(revoked) != 2 || !containsID(revoked, otherID) || !containsID(revoked, thirdID) {
+		t.Fatalf("revoked %v, want %s and %s", revoked, otherID, thirdID)
+	}
+
+	expectActive(t, s, currentID, true)
+	expectActive(t, s, otherID, false)
+	expectActive(t, s, thirdID, false)
+
+	if _, err := s.Refresh(user.RefreshToken, "127.0.0.1"); err != nil {
+		t.Fatalf("refresh the current session: %v", err)
+	}
+	if _, err := s.Refresh(third.RefreshToken, "127.0.0.1"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("refresh a revoked session: got %v, want ErrInvalidRefreshToken", err)
+	}
+	login(t, s, user.User.Username, "new-password")
+}
+
+func containsID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// maxDeviceName bounds the device name stored with a session
+const maxDeviceName = 100
+
+// Device describes where a client signs in from. Clients that do not name
+// themselves get their user agent as the device name.
+type Device struct {
+	DeviceName string            `json:"device_name"`
+	ClientType models.ClientType `json:"client_type" binding:"omitempty,oneof=web desktop android ios"`
+}
+
+// session starts a new token family for the device
+func (d Device) session(familyID uuid.UUID, ip string) models.UserSession {
+	clientType := d.ClientType
+	if clientType == "" {
+		clientType = models.ClientTypeWeb
+	}
+
+	name := d.DeviceName
+	if runes := []rune(name); len(runes) > maxDeviceName {
+		name = string(runes[:maxDeviceName])
+	}
+
+	return models.UserSession{
+		FamilyID:   familyID,
+		DeviceName: name,
+		ClientType: clientType,
+		IP:         ip,
+	}
+}
+
+// ReuseError reports a refresh token that was used twice and the session
+// that was revoked because of it
+type ReuseError struct {
+	UserID    uuid.UUID
+	SessionID uuid.UUID
+}
+
+func (e *ReuseError) Error() string {
+	return fmt.Sprintf("refresh token reuse detected, session %s revoked", e.SessionID)
+}
+
+func (e *ReuseError) Is(target error) bool {
+	return target == ErrRefreshTokenReused
+}
+
+// Sessions returns the signed-in devices of a user, most recently used
+// first. A session is listed through its current refresh token, so its
+// family_id is the id to revoke it by.
+func (s *Service) Sessions(userID, currentID uuid.UUID) ([]models.UserSession, error) {
+	var sessions []models.UserSession
+	err := s.db.Where("user_id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].FamilyID == currentID
+	}
+	return sessions, nil
+}
+
+// RevokeSession signs one of the user's devices out
+func (s *Service) RevokeSession(userID, sessionID uuid.UUID) error {
+	result := s.db.Model(&models.UserSession{}).
+		Where("user_id = ? AND family_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, sessionID, time.Now()).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions signs out every device of the user except the current
+// one and returns the sessions it revoked
+func (s *Service) RevokeOtherSessions(userID, currentID uuid.UUID) ([]uuid.UUID, error) {
+	var revoked []uuid.UUID
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		revoked, err = revokeSessions(tx, userID, currentID)
+		return err
+	})
+	return revoked, err
+}
+
+// revokeSessions revokes every live session of the user except exceptID,
+// which may be uuid.Nil to revoke them all
+func revokeSessions(tx *gorm.DB, userID, exceptID uuid.UUID) ([]uuid.UUID, error) {
+	var revoked []uuid.UUID
+	err := tx.Model(&models.UserSession{}).
+		Where("user_id = ? AND family_id != ? AND revoked_at IS NULL AND expires_at > ?", userID, exceptID, time.Now()).
+		Distinct("family_id").
+		Pluck("family_id", &revoked).Error
+	if err != nil || len(revoked) == 0 {
+		return revoked, err
+	}
+
+	err = tx.Model(&models.UserSession{}).
+		Where("family_id IN ? AND revoked_at IS NULL", revoked).
+		Update("revoked_at", time.Now()).Error
+	return revoked, err
+}
+
+// SessionActive reports whether a session can still be refreshed
+func (s *Service) SessionActive(sessionID uuid.UUID) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.UserSession{}).
+		Where("family_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,17 @@
+package broker
+
+import (
+	"context"
+)
+
+// Handler receives every payload published on the broker, including the
+// ones published by this process. Handlers must not block.
+type Handler func(payload []byte)
+
+// Broker fans WebSocket hub events out to every server instance so that a
+// user connected to one node receives events produced on another
+type Broker interface {
+	Publish(ctx context.Context, payload []byte) error
+	Subscribe(handler Handler) error
+	Close() error
+}
@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrClosed = errors.New("broker is closed")
+
+// MemoryBroker delivers payloads to subscribers in the same process. It is
+// used for single-node deployments and lets several hubs share one broker
+// in tests.
+type MemoryBroker struct {
+	mutex    sync.RWMutex
+	handlers []Handler
+	closed   bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, payload []byte) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	for _, handler := range b.handlers {
+		// Each subscriber gets its own copy, as it would over the network
+		handler(append([]byte(nil), payload...))
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler Handler) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	b.handlers = nil
+	return nil
+}
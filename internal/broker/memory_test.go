@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemoryBrokerDeliversToEverySubscriber(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	var first, second [][]byte
+	if err := b.Subscribe(func(payload []byte) { first = append(first, payload) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := b.Subscribe(func(payload []byte) { second = append(second, payload) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	payload := []byte("event")
+	if err := b.Publish(context.Background(), payload); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	if len(first) != 1 || string(first[0]) != "event" {
+		t.Fatalf("first subscriber got %q", first)
+	}
+	if len(second) != 1 || string(second[0]) != "event" {
+		t.Fatalf("second subscriber got %q", second)
+	}
+
+	// Subscribers get copies, as they would over the network
+	first[0][0] = 'X'
+	if string(second[0]) != "event" || string(payload) != "event" {
+		t.Fatal("payload is shared between subscribers")
+	}
+}
+
+func TestMemoryBrokerClosed(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Close()
+
+	if err := b.Publish(context.Background(), []byte("event")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("publish after close: got %v, want ErrClosed", err)
+	}
+	if err := b.Subscribe(func([]byte) {}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("subscribe after close: got %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"messenger/internal/config"
+	"sync"
+	"time"
+	"github.com/redis/go-redis/v9"
+)
+
+// Delays between attempts to restore a lost subscription
+const (
+	resubscribeMinDelay = time.Second
+	resubscribeMaxDelay = 30 * time.Second
+)
+
+// RedisBroker relays payloads between server instances over Redis Pub/Sub.
+// A subscription whose channel closes is opened again with backoff until
+// the broker is closed.
+type RedisBroker struct {
+	client  *redis.Client
+	channel string
+	mutex   sync.Mutex
+	subs    []*redis.PubSub
+	closed  bool
+}
+
+func NewRedisBroker(cfg *config.RedisConfig) *RedisBroker {
+	client := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		Password: cfg.Password,
+		DB:       cfg.Database,
+	})
+
+	return &RedisBroker{
+		client:  client,
+		channel: cfg.PubSubChannel,
+	}
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, payload []byte) error {
+	if err := b.client.Publish(ctx, b.channel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish to redis: %w", err)
+	}
+	return nil
+}
+
+func (b *RedisBroker) Subscribe(handler Handler) error {
+	sub, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go b.relay(sub, handler)
+	return nil
+}
+
+// subscribe opens a confirmed subscription and keeps it for Close
+func (b *RedisBroker) subscribe() (*redis.PubSub, error) {
+	ctx := context.Background()
+
+	sub := b.client.Subscribe(ctx, b.channel)
+	// Wait for the subscription to be confirmed so no event is missed
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("failed to subscribe to redis: %w", err)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		sub.Close()
+		return nil, ErrClosed
+	}
+	b.subs = append(b.subs, sub)
+	return sub, nil
+}
+
+// relay hands every message of sub to handler. When the channel closes
+// while the broker is still open, it subscribes again and carries on.
+func (b *RedisBroker) relay(sub *redis.PubSub, handler Handler) {
+	for sub != nil {
+		for message := range sub.Channel() {
+			handler([]byte(message.Payload))
+		}
+
+		b.forget(sub)
+		sub = b.resubscribe()
+	}
+}
+
+// resubscribe retries subscribe with backoff. It returns nil once the
+// broker is closed.
+func (b *RedisBroker) resubscribe() *redis.PubSub {
+	delay := resubscribeMinDelay
+	for {
+		if b.isClosed() {
+			return nil
+		}
+
+		sub, err := b.subscribe()
+		if err == nil {
+			log.Printf("Resubscribed to redis channel %s", b.channel)
+			return sub
+		}
+		if errors.Is(err, ErrClosed) {
+			return nil
+		}
+
+		log.Printf("Redis subscription to %s lost, retrying in %s: %v", b.channel, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, resubscribeMaxDelay)
+	}
+}
+
+func (b *RedisBroker) forget(sub *redis.PubSub) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, s := range b.subs {
+		if s == sub {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (b *RedisBroker) isClosed() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.closed
+}
+
+func (b *RedisBroker) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	for _, sub := range b.subs {
+		sub.Close()
+	}
+	b.subs = nil
+	b.mutex.Unlock()
+
+	return b.client.Close()
+}
@@ -0,0 +1,326 @@
+package call
+
+import (
+	"errors"
+	"log"
+	"time"
+	"messenger/internal/websocket"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrCallInProgress is returned with the running call when a chat already
+// has a group call; clients join it instead
+var ErrCallInProgress = errors.New("chat already has a group call")
+
+// ParticipantPayload is the data of a call_participant_updated event
+type ParticipantPayload struct {
+	CallID      uuid.UUID              `json:"call_id"`
+	Participant models.CallParticipant `json:"participant"`
+	ActorID     uuid.UUID              `json:"actor_id"`
+}
+
+// StartGroup starts a group call in chatID with userID as its first
+// participant. Group calls do not ring; chat members see a call_updated
+// event and join when they like.
+func (s *Service) StartGroup(userID, chatID uuid.UUID, callType models.CallType) (*models.Call, error) {
+	if err := s.checkMember(chatID, userID); err != nil {
+		return nil, err
+	}
+	if err := s.checkChat(chatID, callType); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	call := &models.Call{
+		CallerID:  userID,
+		ChatID:    &chatID,
+		Type:      callType,
+		Status:    models.CallStatusActive,
+		StartTime: now,
+	}
+
+	var existingID uuid.UUID
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the chat so two members starting a call at once get one call
+		var chat models.Chat
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", chatID).First(&chat).Error; err != nil {
+			return err
+		}
+
+		var existing models.Call
+		err := tx.Select("id").
+			Where("chat_id = ? AND callee_id IS NULL AND status IN ?", chatID, liveStatuses).
+			First(&existing).Error
+		if err == nil {
+			existingID = existing.ID
+			return ErrCallInProgress
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if err := lockIdle(tx, userID); err != nil {
+			return err
+		}
+		if err := tx.Create(call).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.CallParticipant{
+			CallID:    call.ID,
+			UserID:    userID,
+			JoinedAt:  now,
+			IsVideoOn: callType == models.CallTypeVideo,
+		}).Error
+	})
+	if errors.Is(err, ErrCallInProgress) {
+		existing, loadErr := s.load(existingID)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return existing, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if call, err = s.load(call.ID); err != nil {
+		return nil, err
+	}
+	s.publish(call, userID)
+	return call, nil
+}
+
+// Join adds userID to a running group call, or brings them back after they
+// left. Joining a call one is already in is a no-op.
+func (s *Service) Join(callID, userID uuid.UUID) (*models.Call, error) {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isGroup(call) {
+		return nil, ErrNotGroupCall
+	}
+	for _, participant := range call.Participants {
+		if participant.UserID == userID {
+			return call, nil
+		}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockActive(tx, callID); err != nil {
+			return err
+		}
+		if err := lockIdle(tx, userID); err != nil {
+			return err
+		}
+
+		participant := models.CallParticipant{
+			CallID:    callID,
+			UserID:    userID,
+			JoinedAt:  time.Now(),
+			IsVideoOn: call.Type == models.CallTypeVideo,
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "call_id"}, {Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"joined_at", "left_at", "is_muted", "is_video_on", "updated_at"}),
+		}).Create(&participant).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if call, err = s.load(callID); err != nil {
+		return nil, err
+	}
+	s.publish(call, userID)
+	return call, nil
+}
+
+// Leave takes userID out of a group call; the call ends when the last
+// participant is gone
+func (s *Service) Leave(callID, userID uuid.UUID) (*models.Call, error) {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isGroup(call) {
+		return nil, ErrNotGroupCall
+	}
+	return s.leave(callID, userID, userID)
+}
+
+// UpdateMedia changes userID's own mute and video state in a group call;
+// nil leaves a setting unchanged
+func (s *Service) UpdateMedia(callID, userID uuid.UUID, muted, videoOn *bool) (*models.CallParticipant, error) {
+	updates := make(map[string]interface{})
+	if muted != nil {
+		updates["is_muted"] = *muted
+	}
+	if videoOn != nil {
+		updates["is_video_on"] = *videoOn
+	}
+	return s.updateParticipant(callID, userID, userID, updates)
+}
+
+// MuteParticipant mutes targetID on behalf of a moderator. Unmuting is left
+// to the participant.
+func (s *Service) MuteParticipant(callID, moderatorID, targetID uuid.UUID) (*models.CallParticipant, error) {
+	if err := s.checkModerator(callID, moderatorID); err != nil {
+		return nil, err
+	}
+	return s.updateParticipant(callID, targetID, moderatorID, map[string]interface{}{"is_muted": true})
+}
+
+// RemoveParticipant takes targetID out of a group call on behalf of a
+// moderator
+func (s *Service) RemoveParticipant(callID, moderatorID, targetID uuid.UUID) (*models.Call, error) {
+	if err := s.checkModerator(callID, moderatorID); err != nil {
+		return nil, err
+	}
+	return s.leave(callID, targetID, moderatorID)
+}
+
+func (s *Service) leave(callID, userID, actorID uuid.UUID) (*models.Call, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		call, err := lockCall(tx, callID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.CallParticipant{}).
+			Where("call_id = ? AND user_id = ? AND left_at IS NULL", callID, userID).
+			Update("left_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotParticipant
+		}
+
+		var remaining int64
+		err = tx.Model(&models.CallParticipant{}).
+			Where("call_id = ? AND left_at IS NULL", callID).
+			Count(&remaining).Error
+		if err != nil || remaining > 0 {
+			return err
+		}
+
+		return tx.Model(&models.Call{}).Where("id = ?", callID).Updates(map[string]interface{}{
+			"status":   models.CallStatusEnded,
+			"end_time": now,
+			"duration": int(now.Sub(call.StartTime).Seconds()),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	call, err := s.load(callID)
+	if err != nil {
+		return nil, err
+	}
+	s.publish(call, actorID)
+	return call, nil
+}
+
+// updateParticipant changes a live participant and tells the others
+func (s *Service) updateParticipant(callID, userID, actorID uuid.UUID, updates map[string]interface{}) (*models.CallParticipant, error) {
+	var participant models.CallParticipant
+	err := s.db.Preload("User").
+		Joins("JOIN calls ON calls.id = call_participants.call_id").
+		Where("call_participants.call_id = ? AND call_participants.user_id = ? AND call_participants.left_at IS NULL", callID, userID).
+		Where("calls.status = ?", models.CallStatusActive).
+		First(&participant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotParticipant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(updates) > 0 {
+		if err := s.db.Model(&participant).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	peers, err := s.LiveParticipants(callID)
+	if err != nil {
+		log.Printf("Failed to list participants of call %s: %v", callID, err)
+		return &participant, nil
+	}
+	s.publisher.PublishToUsers(peers, websocket.MessageTypeCallParticipantUpdated, actorID, ParticipantPayload{
+		CallID:      callID,
+		Participant: participant,
+		ActorID:     actorID,
+	})
+	return &participant, nil
+}
+
+// checkModerator allows whoever started the call and the chat's admins and
+// moderators
+func (s *Service) checkModerator(callID, userID uuid.UUID) error {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return err
+	}
+	if !isGroup(call) {
+		return ErrNotGroupCall
+	}
+	if call.CallerID == userID {
+		return nil
+	}
+
+	var count int64
+	err = s.db.Model(&models.ChatMember{}).
+		Where("chat_id = ? AND user_id = ? AND is_active = ? AND role IN ?", *call.ChatID, userID, true,
+			[]models.ChatMemberRole{models.ChatMemberRoleAdmin, models.ChatMemberRoleModerator}).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotModerator
+	}
+	return nil
+}
+
+func (s *Service) checkMember(chatID, userID uuid.UUID) error {
+	var count int64
+	err := s.db.Model(&models.ChatMember{}).
+		Where("chat_id = ? AND user_id = ? AND is_active = ?", chatID, userID, true).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// lockCall locks a call row for the rest of tx
+func lockCall(tx *gorm.DB, callID uuid.UUID) (*models.Call, error) {
+	var call models.Call
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", callID).First(&call).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	return &call, err
+}
+
+// lockActive locks a call and checks that it is still going on
+func lockActive(tx *gorm.DB, callID uuid.UUID) error {
+	call, err := lockCall(tx, callID)
+	if err != nil {
+		return err
+	}
+	if call.Status != models.CallStatusActive {
+		return ErrInvalidTransition
+	}
+	return nil
+}
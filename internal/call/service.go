@@ -0,0 +1,544 @@
+package call
+
+import (
+	"errors"
+	"log"
+	"time"
+	"messenger/internal/config"
+	"messenger/internal/contact"
+	"messenger/internal/websocket"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotFound          = errors.New("call not found")
+	ErrNotParticipant    = errors.New("not a participant of this call")
+	ErrInvalidTransition = errors.New("call cannot move to this state")
+	ErrInvalidCallee     = errors.New("invalid callee")
+	ErrBusy              = errors.New("user is already in a call")
+	ErrBlocked           = errors.New("user is blocked")
+	ErrNotMember         = errors.New("not a member of this chat")
+	ErrNotGroupCall      = errors.New("not a group call")
+	ErrNotModerator      = errors.New("only moderators can do this")
+)
+
+// transitions lists the states a call may move to from each state. Ended,
+// missed, declined and failed are final.
+var transitions = map[models.CallStatus][]models.CallStatus{
+	models.CallStatusInitiated: {models.CallStatusRinging, models.CallStatusMissed, models.CallStatusDeclined, models.CallStatusFailed},
+	models.CallStatusRinging:   {models.CallStatusActive, models.CallStatusMissed, models.CallStatusDeclined, models.CallStatusFailed},
+	models.CallStatusActive:    {models.CallStatusEnded, models.CallStatusFailed},
+}
+
+// liveStatuses are the states in which a call occupies its participants
+var liveStatuses = []models.CallStatus{models.CallStatusInitiated, models.CallStatusRinging, models.CallStatusActive}
+
+// Filter narrows the call history
+type Filter struct {
+	Type   models.CallType
+	Status models.CallStatus
+	Limit  int
+	Offset int
+}
+
+// Service persists calls and moves them through their lifecycle. Every
+// change is pushed as a call_updated event to both sides of a one-to-one
+// call, or to the chat members for a group call.
+type Service struct {
+	db          *gorm.DB
+	publisher   websocket.Publisher
+	contacts    *contact.Service
+	ringTimeout time.Duration
+	ice         *config.CallConfig
+}
+
+func NewService(db *gorm.DB, publisher websocket.Publisher, contacts *contact.Service, cfg *config.CallConfig) *Service {
+	return &Service{
+		db:          db,
+		publisher:   publisher,
+		contacts:    contacts,
+		ringTimeout: time.Duration(cfg.RingTimeout) * time.Second,
+		ice:         cfg,
+	}
+}
+
+// Initiate places a call from callerID to calleeID and starts ringing.
+// chatID optionally ties the call to a chat both users are members of.
+func (s *Service) Initiate(callerID, calleeID uuid.UUID, callType models.CallType, screenShare bool, chatID *uuid.UUID) (*models.Call, error) {
+	if calleeID == callerID {
+		return nil, ErrInvalidCallee
+	}
+
+	var callee models.User
+	if err := s.db.Where("id = ? AND is_active = ?", calleeID, true).First(&callee).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidCallee
+		}
+		return nil, err
+	}
+
+	// Nobody can call across a block, whichever side placed it
+	blocked, err := s.contacts.IsBlocked(callerID, calleeID)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, ErrBlocked
+	}
+
+	// The callee's settings decide what kind of calls they take
+	settings, err := s.checkCallee(calleeID, callType, screenShare)
+	if err != nil {
+		return nil, err
+	}
+
+	if chatID != nil {
+		if err := s.checkChat(*chatID, callType); err != nil {
+			return nil, err
+		}
+
+		var count int64
+		err := s.db.Model(&models.ChatMember{}).
+			Where("chat_id = ? AND user_id IN ? AND is_active = ?", *chatID, []uuid.UUID{callerID, calleeID}, true).
+			Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if count != 2 {
+			return nil, ErrNotMember
+		}
+	}
+
+	call := &models.Call{
+		CallerID:      callerID,
+		CalleeID:      &calleeID,
+		ChatID:        chatID,
+		Type:          callType,
+		Status:        models.CallStatusInitiated,
+		StartTime:     time.Now(),
+		IsScreenShare: screenShare,
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockIdle(tx, callerID, calleeID); err != nil {
+			return err
+		}
+		return tx.Create(call).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The callee is notified right away, so the call is ringing from here on
+	if err := s.transition(call, models.CallStatusRinging, callerID, nil); err != nil {
+		return nil, err
+	}
+
+	// Callees with auto-answer pick up straight away, as long as they have a
+	// device connected to take the call; otherwise it rings as usual
+	if settings.AutoAnswer && connected(&callee) {
+		err := s.transition(call, models.CallStatusActive, calleeID, map[string]interface{}{"start_time": time.Now()})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return call, nil
+}
+
+// SetScreenShare turns screen sharing on or off in an active call. In a
+// one-to-one call the other side must allow screen sharing.
+func (s *Service) SetScreenShare(callID, userID uuid.UUID, enabled bool) (*models.Call, error) {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if call.Status != models.CallStatusActive {
+		return nil, ErrInvalidTransition
+	}
+
+	if isGroup(call) {
+		live, err := s.LiveParticipants(callID)
+		if err != nil {
+			return nil, err
+		}
+		if !containsUser(live, userID) {
+			return nil, ErrNotParticipant
+		}
+	} else if enabled {
+		peerID := call.CallerID
+		if peerID == userID {
+			peerID = *call.CalleeID
+		}
+		if _, err := s.checkCallee(peerID, call.Type, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.db.Model(&models.Call{}).Where("id = ?", callID).Update("is_screen_share", enabled).Error; err != nil {
+		return nil, err
+	}
+
+	if call, err = s.load(callID); err != nil {
+		return nil, err
+	}
+	s.publish(call, userID)
+	return call, nil
+}
+
+// Answer accepts a ringing call; only the callee may answer. The call's
+// StartTime becomes the moment it was answered.
+func (s *Service) Answer(callID, userID uuid.UUID) (*models.Call, error) {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isCallee(call, userID) {
+		return nil, ErrNotParticipant
+	}
+
+	err = s.transition(call, models.CallStatusActive, userID, map[string]interface{}{"start_time": time.Now()})
+	return call, err
+}
+
+// Reject declines a call that has not been answered; only the callee may
+// reject
+func (s *Service) Reject(callID, userID uuid.UUID) (*models.Call, error) {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isCallee(call, userID) {
+		return nil, ErrNotParticipant
+	}
+
+	err = s.transition(call, models.CallStatusDeclined, userID, finish(call))
+	return call, err
+}
+
+// End hangs up. An active call ends and gets its duration; an unanswered
+// call is missed when the caller gives up and declined when the callee does.
+// Hanging up a group call only leaves it.
+func (s *Service) End(callID, userID uuid.UUID) (*models.Call, error) {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if isGroup(call) {
+		return s.Leave(callID, userID)
+	}
+
+	status := models.CallStatusEnded
+	if call.Status != models.CallStatusActive {
+		status = models.CallStatusMissed
+		if isCallee(call, userID) {
+			status = models.CallStatusDeclined
+		}
+	}
+
+	err = s.transition(call, status, userID, finish(call))
+	return call, err
+}
+
+// Fail marks a call that could not be established or dropped
+func (s *Service) Fail(callID, userID uuid.UUID) (*models.Call, error) {
+	call, err := s.Get(callID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.transition(call, models.CallStatusFailed, userID, finish(call))
+	return call, err
+}
+
+// Get returns a call userID takes part in; group calls are visible to all
+// members of their chat
+func (s *Service) Get(callID, userID uuid.UUID) (*models.Call, error) {
+	call, err := s.load(callID)
+	if err != nil {
+		return nil, err
+	}
+
+	if isGroup(call) {
+		if err := s.checkMember(*call.ChatID, userID); err != nil {
+			return nil, err
+		}
+		return call, nil
+	}
+	if call.CallerID != userID && !isCallee(call, userID) {
+		return nil, ErrNotParticipant
+	}
+	return call, nil
+}
+
+func (s *Service) load(callID uuid.UUID) (*models.Call, error) {
+	var call models.Call
+	err := s.db.Preload("Caller").
+		Preload("Callee").
+		Preload("Participants", "left_at IS NULL").
+		Preload("Participants.User").
+		Where("id = ?", callID).
+		First(&call).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// LiveParticipants returns the users of a call that is still ringing or
+// active, for a group call those who have joined and not left; it returns
+// nothing for finished or unknown calls
+func (s *Service) LiveParticipants(callID uuid.UUID) ([]uuid.UUID, error) {
+	var call models.Call
+	err := s.db.Select("id", "caller_id", "callee_id").
+		Where("id = ? AND status IN ?", callID, liveStatuses).
+		First(&call).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if call.CalleeID != nil {
+		return []uuid.UUID{call.CallerID, *call.CalleeID}, nil
+	}
+
+	var userIDs []uuid.UUID
+	err = s.db.Model(&models.CallParticipant{}).
+		Where("call_id = ? AND left_at IS NULL", callID).
+		Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// History returns userID's calls, newest first, and whether more follow.
+// Group calls are included once the user has joined them.
+func (s *Service) History(userID uuid.UUID, filter Filter) ([]models.Call, bool, error) {
+	joined := s.db.Model(&models.CallParticipant{}).Select("call_id").Where("user_id = ?", userID)
+	query := s.db.Preload("Caller").
+		Preload("Callee").
+		Preload("Chat").
+		Where("caller_id = ? OR callee_id = ? OR id IN (?)", userID, userID, joined)
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+
+	var calls []models.Call
+	err := query.Order("created_at DESC").
+		Limit(filter.Limit + 1).
+		Offset(filter.Offset).
+		Find(&calls).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(calls) > filter.Limit
+	if hasMore {
+		calls = calls[:filter.Limit]
+	}
+	return calls, hasMore, nil
+}
+
+// RunTimeouts periodically marks calls nobody answered within the ring
+// timeout as missed and drops the participants that lost their connection
+func (s *Service) RunTimeouts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.expireUnanswered()
+		s.dropDisconnected()
+	}
+}
+
+func (s *Service) expireUnanswered() {
+	var calls []models.Call
+	err := s.db.Preload("Caller").
+		Preload("Callee").
+		Where("status IN ? AND created_at < ?",
+			[]models.CallStatus{models.CallStatusInitiated, models.CallStatusRinging}, time.Now().Add(-s.ringTimeout)).
+		Find(&calls).Error
+	if err != nil {
+		log.Printf("Failed to list unanswered calls: %v", err)
+		return
+	}
+
+	for i := range calls {
+		err := s.transition(&calls[i], models.CallStatusMissed, uuid.Nil, finish(&calls[i]))
+		if err != nil && !errors.Is(err, ErrInvalidTransition) {
+			log.Printf("Failed to time out call %s: %v", calls[i].ID, err)
+		}
+	}
+}
+
+// dropDisconnected fails one-to-one calls whose caller, or whose callee once
+// answered, has had no device connected for websocket.PresenceTimeout, and
+// takes such users out of group calls. Without it a crashed client would
+// keep both sides busy forever. An unanswered call to an offline callee is
+// left to ring out as missed.
+func (s *Service) dropDisconnected() {
+	disconnected := s.db.Model(&models.User{}).
+		Select("id").
+		Where("heartbeat_at IS NULL OR heartbeat_at < ?", time.Now().Add(-websocket.PresenceTimeout))
+
+	var calls []models.Call
+	err := s.db.Where("callee_id IS NOT NULL AND status IN ?", liveStatuses).
+		Where("caller_id IN (?) OR (status = ? AND callee_id IN (?))", disconnected, models.CallStatusActive, disconnected).
+		Find(&calls).Error
+	if err != nil {
+		log.Printf("Failed to list calls with disconnected participants: %v", err)
+		return
+	}
+
+	for i := range calls {
+		err := s.transition(&calls[i], models.CallStatusFailed, uuid.Nil, finish(&calls[i]))
+		if err != nil && !errors.Is(err, ErrInvalidTransition) {
+			log.Printf("Failed to drop call %s: %v", calls[i].ID, err)
+		}
+	}
+
+	var participants []models.CallParticipant
+	err = s.db.Joins("JOIN calls ON calls.id = call_participants.call_id").
+		Where("calls.status IN ? AND call_participants.left_at IS NULL", liveStatuses).
+		Where("call_participants.user_id IN (?)", disconnected).
+		Find(&participants).Error
+	if err != nil {
+		log.Printf("Failed to list disconnected call participants: %v", err)
+		return
+	}
+
+	for _, participant := range participants {
+		_, err := s.leave(participant.CallID, participant.UserID, uuid.Nil)
+		if err != nil && !errors.Is(err, ErrNotParticipant) {
+			log.Printf("Failed to drop user %s from call %s: %v", participant.UserID, participant.CallID, err)
+		}
+	}
+}
+
+// transition moves call to status if the state machine allows it. The
+// update only applies while the call is still in the state it was loaded
+// in, so concurrent changes cannot both win. actorID is the user who caused
+// the change, uuid.Nil for timeouts.
+func (s *Service) transition(call *models.Call, status models.CallStatus, actorID uuid.UUID, updates map[string]interface{}) error {
+	if !allowed(call.Status, status) {
+		return ErrInvalidTransition
+	}
+
+	if updates == nil {
+		updates = make(map[string]interface{})
+	}
+	updates["status"] = status
+
+	result := s.db.Model(&models.Call{}).
+		Where("id = ? AND status = ?", call.ID, call.Status).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTransition
+	}
+
+	reloaded, err := s.load(call.ID)
+	if err != nil {
+		return err
+	}
+	*call = *reloaded
+
+	s.publish(call, actorID)
+	return nil
+}
+
+// publish announces the current state of call
+func (s *Service) publish(call *models.Call, actorID uuid.UUID) {
+	if isGroup(call) {
+		if err := s.publisher.PublishToChat(*call.ChatID, websocket.MessageTypeCallUpdated, actorID, call); err != nil {
+			log.Printf("Failed to publish call %s: %v", call.ID, err)
+		}
+		return
+	}
+	s.publisher.PublishToUsers([]uuid.UUID{call.CallerID, *call.CalleeID}, websocket.MessageTypeCallUpdated, actorID, call)
+}
+
+// lockIdle locks the given users for the rest of tx and fails with ErrBusy
+// when any of them is already in a live call, so two calls racing for the
+// same user cannot both go through
+func lockIdle(tx *gorm.DB, userIDs ...uuid.UUID) error {
+	var users []models.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		Where("id IN ?", userIDs).
+		Order("id").
+		Find(&users).Error
+	if err != nil {
+		return err
+	}
+
+	var busy int64
+	err = tx.Model(&models.Call{}).
+		Where("status IN ?", liveStatuses).
+		Where("(callee_id IS NOT NULL AND (caller_id IN ? OR callee_id IN ?)) OR id IN (?)",
+			userIDs, userIDs,
+			tx.Model(&models.CallParticipant{}).Select("call_id").Where("user_id IN ? AND left_at IS NULL", userIDs)).
+		Count(&busy).Error
+	if err != nil {
+		return err
+	}
+	if busy > 0 {
+		return ErrBusy
+	}
+	return nil
+}
+
+func containsUser(userIDs []uuid.UUID, userID uuid.UUID) bool {
+	for _, id := range userIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// connected reports whether a hub has seen a device of user recently
+func connected(user *models.User) bool {
+	return user.HeartbeatAt != nil && time.Since(*user.HeartbeatAt) < websocket.PresenceTimeout
+}
+
+func isGroup(call *models.Call) bool {
+	return call.CalleeID == nil
+}
+
+func isCallee(call *models.Call, userID uuid.UUID) bool {
+	return call.CalleeID != nil && *call.CalleeID == userID
+}
+
+// finish returns the updates that close a call: the end time and, for a
+// call that was answered, how long it lasted
+func finish(call *models.Call) map[string]interface{} {
+	now := time.Now()
+	duration := 0
+	if call.Status == models.CallStatusActive {
+		duration = int(now.Sub(call.StartTime).Seconds())
+	}
+	return map[string]interface{}{
+		"end_time": now,
+		"duration": duration,
+	}
+}
+
+func allowed(from, to models.CallStatus) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package call
+
+import (
+	"errors"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrVoiceCallsDisabled  = errors.New("voice calls are not allowed")
+	ErrVideoCallsDisabled  = errors.New("video calls are not allowed")
+	ErrScreenShareDisabled = errors.New("screen sharing is not allowed")
+	ErrInvalidSettings     = errors.New("invalid call settings")
+)
+
+// CallQualities are the accepted values of CallSettings.CallQuality
+var CallQualities = []string{"auto", "low", "medium", "high"}
+
+// SettingsUpdate changes some of a user's call settings; nil fields are kept
+type SettingsUpdate struct {
+	AllowVoiceCalls  *bool   `json:"allow_voice_calls"`
+	AllowVideoCalls  *bool   `json:"allow_video_calls"`
+	AllowScreenShare *bool   `json:"allow_screen_share"`
+	AutoAnswer       *bool   `json:"auto_answer"`
+	RingtonePath     *string `json:"ringtone_path"`
+	CallQuality      *string `json:"call_quality"`
+}
+
+// Settings returns userID's call settings. Users who never saved any get
+// the defaults, which allow everything.
+func (s *Service) Settings(userID uuid.UUID) (*models.CallSettings, error) {
+	settings := models.CallSettings{
+		UserID:           userID,
+		AllowVoiceCalls:  true,
+		AllowVideoCalls:  true,
+		AllowScreenShare: true,
+		CallQuality:      "auto",
+	}
+	err := s.db.Where("user_id = ?", userID).First(&settings).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// UpdateSettings applies update to userID's call settings
+func (s *Service) UpdateSettings(userID uuid.UUID, update *SettingsUpdate) (*models.CallSettings, error) {
+	settings, err := s.Settings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.AllowVoiceCalls != nil {
+		settings.AllowVoiceCalls = *update.AllowVoiceCalls
+	}
+	if update.AllowVideoCalls != nil {
+		settings.AllowVideoCalls = *update.AllowVideoCalls
+	}
+	if update.AllowScreenShare != nil {
+		settings.AllowScreenShare = *update.AllowScreenShare
+	}
+	if update.AutoAnswer != nil {
+		settings.AutoAnswer = *update.AutoAnswer
+	}
+	if update.RingtonePath != nil {
+		settings.RingtonePath = *update.RingtonePath
+	}
+	if update.CallQuality != nil {
+		if !validQuality(*update.CallQuality) {
+			return nil, ErrInvalidSettings
+		}
+		settings.CallQuality = *update.CallQuality
+	}
+
+	// Boolean columns have database defaults, so they are written explicitly
+	err = s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"allow_voice_calls", "allow_video_calls", "allow_screen_share",
+			"auto_answer", "ringtone_path", "call_quality", "updated_at",
+		}),
+	}).Select("*").Omit("id", "User").Create(settings).Error
+	if err != nil {
+		return nil, err
+	}
+	return s.Settings(userID)
+}
+
+// checkCallee verifies that calleeID accepts a call of callType, with
+// screen sharing when screenShare is set
+func (s *Service) checkCallee(calleeID uuid.UUID, callType models.CallType, screenShare bool) (*models.CallSettings, error) {
+	settings, err := s.Settings(calleeID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case callType == models.CallTypeVoice && !settings.AllowVoiceCalls:
+		return nil, ErrVoiceCallsDisabled
+	case callType == models.CallTypeVideo && !settings.AllowVideoCalls:
+		return nil, ErrVideoCallsDisabled
+	case screenShare && !settings.AllowScreenShare:
+		return nil, ErrScreenShareDisabled
+	}
+	return settings, nil
+}
+
+// checkChat verifies that chatID allows calls of callType
+func (s *Service) checkChat(chatID uuid.UUID, callType models.CallType) error {
+	var settings models.ChatSettings
+	err := s.db.Where("chat_id = ?", chatID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Chats without settings allow every kind of call
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if callType == models.CallTypeVoice && !settings.AllowVoiceCalls {
+		return ErrVoiceCallsDisabled
+	}
+	if callType == models.CallTypeVideo && !settings.AllowVideoCalls {
+		return ErrVideoCallsDisabled
+	}
+	return nil
+}
+
+func validQuality(quality string) bool {
+	for _, value := range CallQualities {
+		if value == quality {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package call
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+	"github.com/google/uuid"
+)
+
+// ICEServer is one entry of RTCConfiguration.iceServers
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEConfig is what clients need to set up a peer connection
+type ICEConfig struct {
+	ICEServers []ICEServer `json:"ice_servers"`
+	// ExpiresAt is when the TURN credentials stop working; clients fetch
+	// new ones before starting a call after that
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// TURNCredentials implements the TURN REST API shared-secret scheme: the
+// username is "<expiry unix time>:<user id>" and the password is the
+// base64 HMAC-SHA1 of the username keyed with the secret the TURN server
+// shares. The server recomputes it, so nothing has to be stored.
+func TURNCredentials(secret string, userID uuid.UUID, expiresAt time.Time) (username, credential string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID.String()
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ICEServers returns the STUN servers and, when TURN is configured,
+// credentials for userID valid for the configured TTL
+func (s *Service) ICEServers(userID uuid.UUID) *ICEConfig {
+	config := &ICEConfig{ICEServers: []ICEServer{}}
+	if len(s.ice.STUNURLs) > 0 {
+		config.ICEServers = append(config.ICEServers, ICEServer{URLs: s.ice.STUNURLs})
+	}
+
+	if len(s.ice.TURNURLs) > 0 && s.ice.TURNSecret != "" {
+		expiresAt := time.Now().Add(time.Duration(s.ice.TURNCredentialTTL) * time.Second).Truncate(time.Second)
+		username, credential := TURNCredentials(s.ice.TURNSecret, userID, expiresAt)
+		config.ICEServers = append(config.ICEServers, ICEServer{
+			URLs:       s.ice.TURNURLs,
+			Username:   username,
+			Credential: credential,
+		})
+		config.ExpiresAt = &expiresAt
+	}
+	return config
+}
@@ -0,0 +1,134 @@
+package call
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"messenger/internal/config"
+	"github.com/google/uuid"
+)
+
+func TestTURNCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		userID     string
+		expiresAt  int64
+		username   string
+		credential string
+	}{
+		{
+			name:       "coturn example",
+			secret:     "secret",
+			userID:     "3f2504e0-4f89-11d3-9a0c-0305e82c3301",
+			expiresAt:  1700000000,
+			username:   "1700000000:3f2504e0-4f89-11d3-9a0c-0305e82c3301",
+			credential: "wXx1kZMA+xCdL6K4qY9FqoEAsNk=",
+		},
+		{
+			name:       "other secret",
+			secret:     "north",
+			userID:     "00000000-0000-0000-0000-000000000001",
+			expiresAt:  1234567890,
+			username:   "1234567890:00000000-0000-0000-0000-000000000001",
+			credential: "Bd1uj2OKLHFTNdIAzIPEBDJU9xg=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, credential := TURNCredentials(tt.secret, uuid.MustParse(tt.userID), time.Unix(tt.expiresAt, 0))
+			if username != tt.username {
+				t.Errorf("username = %q, want %q", username, tt.username)
+			}
+			if credential != tt.credential {
+				t.Errorf("credential = %q, want %q", credential, tt.credential)
+			}
+		})
+	}
+}
+
+// verifyTURN checks credentials the way a TURN server with a shared secret
+// does
+func verifyTURN(secret, username, credential string, now time.Time) bool {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	if base64.StdEncoding.EncodeToString(mac.Sum(nil)) != credential {
+		return false
+	}
+
+	expiry, _, ok := strings.Cut(username, ":")
+	if !ok {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && now.Unix() < expiresAt
+}
+
+func TestICEServers(t *testing.T) {
+	userID := uuid.New()
+	s := &Service{ice: &config.CallConfig{
+		STUNURLs:          []string{"stun:stun.example.com:3478"},
+		TURNURLs:          []string{"turn:turn.example.com:3478"},
+		TURNSecret:        "secret",
+		TURNCredentialTTL: 600,
+	}}
+
+	before := time.Now()
+	ice := s.ICEServers(userID)
+
+	if len(ice.ICEServers) != 2 {
+		t.Fatalf("got %d ice servers, want stun and turn", len(ice.ICEServers))
+	}
+	if stun := ice.ICEServers[0]; stun.Username != "" || stun.Credential != "" {
+		t.Errorf("stun server carries credentials: %+v", stun)
+	}
+
+	turn := ice.ICEServers[1]
+	if ice.ExpiresAt == nil {
+		t.Fatal("expires_at is not set")
+	}
+	if ttl := ice.ExpiresAt.Sub(before); ttl < 599*time.Second || ttl > 601*time.Second {
+		t.Errorf("credentials live %s, want the configured 10m", ttl)
+	}
+	if want := strconv.FormatInt(ice.ExpiresAt.Unix(), 10) + ":" + userID.String(); turn.Username != want {
+		t.Errorf("username = %q, want %q", turn.Username, want)
+	}
+
+	if !verifyTURN("secret", turn.Username, turn.Credential, before) {
+		t.Error("turn server rejects fresh credentials")
+	}
+	if verifyTURN("other", turn.Username, turn.Credential, before) {
+		t.Error("credentials verify with another secret")
+	}
+	if verifyTURN("secret", turn.Username, turn.Credential, ice.ExpiresAt.Add(time.Second)) {
+		t.Error("credentials still verify after they expire")
+	}
+}
+
+func TestICEServersWithoutTURN(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.CallConfig
+	}{
+		{"no turn urls", config.CallConfig{STUNURLs: []string{"stun:stun.example.com"}, TURNSecret: "secret", TURNCredentialTTL: 600}},
+		{"no secret", config.CallConfig{STUNURLs: []string{"stun:stun.example.com"}, TURNURLs: []string{"turn:turn.example.com"}, TURNCredentialTTL: 600}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{ice: &tt.cfg}
+			ice := s.ICEServers(uuid.New())
+			if len(ice.ICEServers) != 1 || ice.ICEServers[0].Username != "" {
+				t.Fatalf("got %+v, want only the stun server", ice.ICEServers)
+			}
+			if ice.ExpiresAt != nil {
+				t.Errorf("expires_at = %v, want none", ice.ExpiresAt)
+			}
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
 	"os"
 	"strconv"
+	"strings"
 	"github.com/joho/godotenv"
 )
 
@@ -12,6 +17,10 @@ type Config struct {
 	Redis    RedisConfig
 	JWT      JWTConfig
 	File     FileConfig
+	S3       S3Config
+	Call     CallConfig
+	Contact  ContactConfig
+	Mail     MailConfig
 }
 
 type ServerConfig struct {
@@ -36,17 +45,91 @@ type RedisConfig struct {
 	Port     string
 	Password string
 	Database int
+	PubSubEnabled bool   // relay WebSocket events between server instances
+	PubSubChannel string
 }
 
 type JWTConfig struct {
-	Secret    string
-	ExpiresIn int // hours
+	Secret     string
+	AccessTTL  int // minutes
+	RefreshTTL int // hours
 }
 
 type FileConfig struct {
+	Storage    string // "local" or "s3"
 	UploadPath string
 	MaxSize    int64 // bytes
 	AllowedTypes []string
+
+	// Resumable uploads are staged under SessionPath until complete
+	SessionPath      string
+	MaxResumableSize int64 // bytes
+	SessionTTL       int   // hours
+
+	// Signed download links
+	URLSecret string
+	URLTTL    int // minutes
+
+	// Storage quotas in bytes (0 = unlimited); users and chats may override
+	// them individually
+	UserQuota int64
+	ChatQuota int64
+
+	// Media processing: thumbnails are generated for each size (longest
+	// side in pixels); videos need ffmpeg and ffprobe on the PATH
+	ThumbnailSizes []int
+	MediaWorkers   int
+	FFmpegPath     string
+	FFprobePath    string
+}
+
+type CallConfig struct {
+	RingTimeout int // seconds before an unanswered call is missed
+
+	// ICE servers handed to clients. TURN credentials are derived from
+	// TURNSecret with the TURN REST API scheme (coturn's
+	// static-auth-secret) and expire after TURNCredentialTTL.
+	STUNURLs          []string
+	TURNURLs          []string
+	TURNSecret        string
+	TURNCredentialTTL int // seconds
+}
+
+type ContactConfig struct {
+	// MatchDailyLimit caps how many emails and email hashes a user may look
+	// up per day, so contact matching cannot be used to probe which
+	// addresses have accounts
+	MatchDailyLimit int
+}
+
+// MailConfig configures account emails. Driver is "smtp" or "log"; the log
+// driver only prints messages and suits local development.
+type MailConfig struct {
+	Driver string
+	From   string
+
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// AppURL is the web client address links in emails point to
+	AppURL string
+
+	// Lifetime of emailed links
+	VerificationTTL int // hours
+	ResetTTL        int // minutes
+}
+
+// S3Config describes an S3-compatible object store used when
+// FileConfig.Storage is "s3"
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
 }
 
 func LoadConfig() (*Config, error) {
@@ -74,27 +157,87 @@ func LoadConfig() (*Config, error) {
 			Port:     getEnv("REDIS_PORT", "6379"),
 			Password: getEnv("REDIS_PASSWORD", ""),
 			Database: getEnvAsInt("REDIS_DB", 0),
+			PubSubEnabled: getEnvAsBool("REDIS_PUBSUB_ENABLED", false),
+			PubSubChannel: getEnv("REDIS_PUBSUB_CHANNEL", "messenger:events"),
 		},
 		JWT: JWTConfig{
-			Secret:    getEnv("JWT_SECRET", "your-secret-key"),
-			ExpiresIn: getEnvAsInt("JWT_EXPIRES_IN", 24),
+			Secret:     getEnv("JWT_SECRET", "your-secret-key"),
+			AccessTTL:  getEnvAsInt("JWT_ACCESS_TTL", 15),
+			RefreshTTL: getEnvAsInt("JWT_REFRESH_TTL", 24*30),
 		},
 		File: FileConfig{
+			Storage:    getEnv("STORAGE_BACKEND", "local"),
 			UploadPath: getEnv("UPLOAD_PATH", "./uploads"),
 			MaxSize:    getEnvAsInt64("MAX_FILE_SIZE", 10*1024*1024), // 10MB
-			AllowedTypes: []string{
+			// Matched against the type sniffed from the file content
+			AllowedTypes: getEnvAsSlice("ALLOWED_FILE_TYPES", []string{
 				"image/jpeg", "image/png", "image/gif", "image/webp",
-				"video/mp4", "video/avi", "video/mov", "video/webm",
-				"audio/mp3", "audio/wav", "audio/ogg", "audio/m4a",
-				"application/pdf", "application/doc", "application/docx",
-				"application/zip", "application/rar", "text/plain",
-			},
+				"video/mp4", "video/x-msvideo", "video/quicktime", "video/webm",
+				"audio/mpeg", "audio/wav", "audio/ogg", "audio/x-m4a",
+				"application/pdf", "application/msword",
+				"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+				"application/zip", "application/x-rar-compressed", "text/plain",
+			}),
+			SessionPath:      getEnv("UPLOAD_SESSION_PATH", "./upload-sessions"),
+			MaxResumableSize: getEnvAsInt64("MAX_RESUMABLE_FILE_SIZE", 512*1024*1024), // 512MB
+			SessionTTL:       getEnvAsInt("UPLOAD_SESSION_TTL", 24),
+			URLSecret:        getEnv("FILE_URL_SECRET", ""),
+			URLTTL:           getEnvAsInt("FILE_URL_TTL", 15),
+			UserQuota:        getEnvAsInt64("USER_STORAGE_QUOTA", 1024*1024*1024),   // 1GB
+			ChatQuota:        getEnvAsInt64("CHAT_STORAGE_QUOTA", 10*1024*1024*1024), // 10GB
+			ThumbnailSizes:   getEnvAsIntSlice("THUMBNAIL_SIZES", []int{160, 320, 640}),
+			MediaWorkers:     getEnvAsInt("MEDIA_WORKERS", 2),
+			FFmpegPath:       getEnv("FFMPEG_PATH", "ffmpeg"),
+			FFprobePath:      getEnv("FFPROBE_PATH", "ffprobe"),
+		},
+		Call: CallConfig{
+			RingTimeout:       getEnvAsInt("CALL_RING_TIMEOUT", 45),
+			STUNURLs:          getEnvAsSlice("STUN_URLS", []string{"stun:stun.l.google.com:19302"}),
+			TURNURLs:          getEnvAsSlice("TURN_URLS", nil),
+			TURNSecret:        getEnv("TURN_SECRET", ""),
+			TURNCredentialTTL: getEnvAsInt("TURN_CREDENTIAL_TTL", 3600),
 		},
+		Contact: ContactConfig{
+			MatchDailyLimit: getEnvAsInt("CONTACT_MATCH_DAILY_LIMIT", 2000),
+		},
+		Mail: MailConfig{
+			Driver:          getEnv("MAIL_DRIVER", "log"),
+			From:            getEnv("MAIL_FROM", "Messenger <no-reply@localhost>"),
+			SMTPHost:        getEnv("SMTP_HOST", "localhost"),
+			SMTPPort:        getEnv("SMTP_PORT", "587"),
+			SMTPUsername:    getEnv("SMTP_USERNAME", ""),
+			SMTPPassword:    getEnv("SMTP_PASSWORD", ""),
+			AppURL:          strings.TrimRight(getEnv("APP_URL", "http://localhost:8080"), "/"),
+			VerificationTTL: getEnvAsInt("EMAIL_VERIFICATION_TTL", 48),
+			ResetTTL:        getEnvAsInt("PASSWORD_RESET_TTL", 60),
+		},
+		S3: S3Config{
+			Endpoint:  getEnv("S3_ENDPOINT", "localhost:9000"),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			Bucket:    getEnv("S3_BUCKET", "messenger"),
+			AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_SECRET_KEY", ""),
+			UseSSL:    getEnvAsBool("S3_USE_SSL", false),
+		},
+	}
+
+	// Without a secret of their own, download links are signed with a key
+	// derived from the JWT secret, so the same key never signs both
+	if config.File.URLSecret == "" {
+		log.Println("FILE_URL_SECRET is not set, deriving the download link key from JWT_SECRET")
+		config.File.URLSecret = deriveKey(config.JWT.Secret, "messenger file urls")
 	}
 
 	return config, nil
 }
 
+// deriveKey turns a secret into an independent key for one purpose
+func deriveKey(secret, label string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(label))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -111,6 +254,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsInt64(key string, defaultValue int64) int64 {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
@@ -118,4 +270,34 @@ func getEnvAsInt64(key string, defaultValue int64) int64 {
 		}
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvAsSlice(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	return defaultValue
+}
+
+func getEnvAsIntSlice(key string, defaultValue []int) []int {
+	items := getEnvAsSlice(key, nil)
+	if items == nil {
+		return defaultValue
+	}
+
+	values := make([]int, 0, len(items))
+	for _, item := range items {
+		value, err := strconv.Atoi(item)
+		if err != nil || value <= 0 {
+			return defaultValue
+		}
+		values = append(values, value)
+	}
+	return values
+}
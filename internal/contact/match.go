@@ -0,0 +1,199 @@
+package contact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxMatchBatch is the most emails and hashes one lookup may carry
+const MaxMatchBatch = 1000
+
+// emailHash is HashEmail in SQL
+const emailHash = "encode(sha256(convert_to(lower(trim(users.email)), 'UTF8')), 'hex')"
+
+// Profile is the public part of a matched user. Emails are only echoed back
+// when the caller sent them in plain text.
+type Profile struct {
+	ID        uuid.UUID `json:"id"`
+	Username  string    `json:"username"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Avatar    string    `json:"avatar"`
+}
+
+// Match is an email or email hash that belongs to an existing user
+type Match struct {
+	Email string  `json:"email,omitempty"`
+	Hash  string  `json:"hash,omitempty"`
+	User  Profile `json:"user"`
+	// Status is the contact status after adding, empty when nothing was added
+	Status models.ContactStatus `json:"status,omitempty"`
+}
+
+// HashEmail is how clients hash an address they do not want to reveal: hex
+// SHA-256 of the trimmed, lower-cased email
+func HashEmail(email string) string {
+	sum := sha256.Sum256([]byte(NormalizeEmail(email)))
+	return hex.EncodeToString(sum[:])
+}
+
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Match looks up which emails and hashes belong to active users. userID
+// itself and users on either side of a block with userID are left out.
+// Every distinct email and hash counts against the daily limit of userID;
+// ErrMatchLimit means the lookup would go over it and nothing was matched.
+func (s *Service) Match(userID uuid.UUID, emails, hashes []string) ([]Match, error) {
+	emailSet := normalizeAll(emails, NormalizeEmail)
+	hashSet := normalizeAll(hashes, func(hash string) string { return strings.ToLower(strings.TrimSpace(hash)) })
+	if len(emailSet) == 0 && len(hashSet) == 0 {
+		return []Match{}, nil
+	}
+
+	if err := s.spendMatchBudget(userID, len(emailSet)+len(hashSet)); err != nil {
+		return nil, err
+	}
+
+	blockedIDs, err := s.BlockedIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []models.User
+	query := s.db.Where("is_active = ? AND id != ?", true, userID)
+	switch {
+	case len(emailSet) > 0 && len(hashSet) > 0:
+		query = query.Where("lower(trim(email)) IN ? OR "+emailHash+" IN ?", emailSet, hashSet)
+	case len(emailSet) > 0:
+		query = query.Where("lower(trim(email)) IN ?", emailSet)
+	default:
+		query = query.Where(emailHash+" IN ?", hashSet)
+	}
+	if len(blockedIDs) > 0 {
+		query = query.Where("id NOT IN ?", blockedIDs)
+	}
+	if err := query.Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	// Report every match in the form it was asked for, so a client that
+	// sent hashes never gets an address back
+	byEmail := make(map[string]Profile, len(users))
+	byHash := make(map[string]Profile, len(users))
+	for _, user := range users {
+		profile := Profile{
+			ID:        user.ID,
+			Username:  user.Username,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Avatar:    user.Avatar,
+		}
+		byEmail[NormalizeEmail(user.Email)] = profile
+		byHash[HashEmail(user.Email)] = profile
+	}
+
+	matches := make([]Match, 0, len(users))
+	for _, email := range emailSet {
+		if profile, ok := byEmail[email]; ok {
+			matches = append(matches, Match{Email: email, User: profile})
+		}
+	}
+	for _, hash := range hashSet {
+		if profile, ok := byHash[hash]; ok {
+			matches = append(matches, Match{Hash: hash, User: profile})
+		}
+	}
+	return matches, nil
+}
+
+// AddMatches sends userID's contact requests to every matched user and
+// records the resulting status on each match. nicknames optionally names
+// users by ID. A user matched twice is only asked once.
+func (s *Service) AddMatches(userID uuid.UUID, matches []Match, nicknames map[uuid.UUID]string) error {
+	statuses := make(map[uuid.UUID]models.ContactStatus, len(matches))
+	for i := range matches {
+		contactID := matches[i].User.ID
+		if status, ok := statuses[contactID]; ok {
+			matches[i].Status = status
+			continue
+		}
+
+		contact, err := s.Add(userID, contactID, nicknames[contactID])
+		switch {
+		case err == nil:
+			statuses[contactID] = contact.Status
+		case errors.Is(err, ErrAlreadyContact):
+			statuses[contactID] = models.ContactStatusAccepted
+		case errors.Is(err, ErrRequestPending):
+			statuses[contactID] = models.ContactStatusPending
+		default:
+			return err
+		}
+		matches[i].Status = statuses[contactID]
+	}
+	return nil
+}
+
+// spendMatchBudget adds count lookups to today's usage of userID, unless
+// that would take it over the daily limit. The check and the increment are
+// one statement, so concurrent lookups cannot both slip under the limit.
+func (s *Service) spendMatchBudget(userID uuid.UUID, count int) error {
+	if s.matchDailyLimit <= 0 {
+		return nil
+	}
+	if count > s.matchDailyLimit {
+		return ErrMatchLimit
+	}
+
+	// A row from an earlier day starts over instead of adding up
+	usage := models.ContactMatchUsage{
+		UserID: userID,
+		Day:    time.Now().UTC().Truncate(24 * time.Hour),
+		Count:  count,
+	}
+	result := s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"count": gorm.Expr("CASE WHEN contact_match_usages.day = excluded.day THEN contact_match_usages.count + excluded.count ELSE excluded.count END"),
+			"day":   gorm.Expr("excluded.day"),
+		}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{
+				SQL:  "contact_match_usages.day <> excluded.day OR contact_match_usages.count + excluded.count <= ?",
+				Vars: []interface{}{s.matchDailyLimit},
+			},
+		}},
+	}).Create(&usage)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrMatchLimit
+	}
+	return nil
+}
+
+// normalizeAll normalizes values and drops blanks and duplicates, keeping
+// the original order
+func normalizeAll(values []string, normalize func(string) string) []string {
+	seen := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		value = normalize(value)
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		result = append(result, value)
+	}
+	return result
+}
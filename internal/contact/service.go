@@ -0,0 +1,415 @@
+package contact
+
+import (
+	"errors"
+	"messenger/internal/config"
+	"messenger/internal/websocket"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotFound       = errors.New("contact not found")
+	ErrInvalidUser    = errors.New("invalid user")
+	ErrAlreadyContact = errors.New("already a contact")
+	ErrRequestPending = errors.New("contact request already sent")
+	ErrNoRequest      = errors.New("no pending contact request")
+	ErrBlocked        = errors.New("user is blocked")
+	ErrMatchLimit     = errors.New("daily contact match limit reached")
+)
+
+// Requests are the pending contact requests of a user in both directions
+type Requests struct {
+	Incoming []models.Contact `json:"incoming"`
+	Outgoing []models.Contact `json:"outgoing"`
+}
+
+// Service manages contact lists and blocks. A contact needs both sides:
+// adding someone stores a pending request on the requester's row, and the
+// other user accepting it creates their own row. Blocks are one-sided and
+// are kept on the blocker's row even when the two are not contacts.
+type Service struct {
+	db              *gorm.DB
+	publisher       websocket.Publisher
+	matchDailyLimit int
+}
+
+func NewService(db *gorm.DB, publisher websocket.Publisher, contactConfig *config.ContactConfig) *Service {
+	return &Service{
+		db:              db,
+		publisher:       publisher,
+		matchDailyLimit: contactConfig.MatchDailyLimit,
+	}
+}
+
+// List returns the accepted contacts of userID, blocked ones included
+func (s *Service) List(userID uuid.UUID) ([]models.Contact, error) {
+	var contacts []models.Contact
+	err := s.db.Preload("Contact").
+		Where("user_id = ? AND status = ?", userID, models.ContactStatusAccepted).
+		Order("created_at").
+		Find(&contacts).Error
+	return contacts, err
+}
+
+// Blocked returns everybody userID has blocked
+func (s *Service) Blocked(userID uuid.UUID) ([]models.Contact, error) {
+	var contacts []models.Contact
+	err := s.db.Preload("Contact").
+		Where("user_id = ? AND is_blocked = ?", userID, true).
+		Order("updated_at DESC").
+		Find(&contacts).Error
+	return contacts, err
+}
+
+// Requests returns the requests waiting for userID and the ones userID sent
+func (s *Service) Requests(userID uuid.UUID) (*Requests, error) {
+	requests := &Requests{}
+	err := s.db.Preload("User").
+		Where("contact_id = ? AND status = ?", userID, models.ContactStatusPending).
+		Order("created_at DESC").
+		Find(&requests.Incoming).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Preload("Contact").
+		Where("user_id = ? AND status = ?", userID, models.ContactStatusPending).
+		Order("created_at DESC").
+		Find(&requests.Outgoing).Error
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// Add sends a contact request from userID to contactID. When contactID has
+// already asked for the same, the request is accepted right away.
+func (s *Service) Add(userID, contactID uuid.UUID, nickname string) (*models.Contact, error) {
+	if userID == contactID {
+		return nil, ErrInvalidUser
+	}
+
+	var target models.User
+	if err := s.db.Where("id = ? AND is_active = ?", contactID, true).First(&target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidUser
+		}
+		return nil, err
+	}
+
+	var own *models.Contact
+	accepted := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		mine, theirs, err := lockPair(tx, userID, contactID)
+		if err != nil {
+			return err
+		}
+		if (mine != nil && mine.IsBlocked) || (theirs != nil && theirs.IsBlocked) {
+			return ErrBlocked
+		}
+
+		status := models.ContactStatusPending
+		if theirs != nil && theirs.Status == models.ContactStatusPending {
+			status = models.ContactStatusAccepted
+			if err := tx.Model(theirs).Update("status", models.ContactStatusAccepted).Error; err != nil {
+				return err
+			}
+		}
+
+		if mine == nil {
+			own = &models.Contact{UserID: userID, ContactID: contactID, Status: status, Nickname: nickname}
+			accepted = status == models.ContactStatusAccepted
+			return tx.Create(own).Error
+		}
+
+		switch mine.Status {
+		case models.ContactStatusAccepted:
+			return ErrAlreadyContact
+		case models.ContactStatusPending:
+			if status == models.ContactStatusPending {
+				return ErrRequestPending
+			}
+		}
+
+		updates := map[string]interface{}{"status": status}
+		if nickname != "" {
+			updates["nickname"] = nickname
+		}
+		own = mine
+		accepted = status == models.ContactStatusAccepted
+		return tx.Model(own).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contact, err := s.get(own.ID, "Contact")
+	if err != nil {
+		return nil, err
+	}
+
+	if accepted {
+		s.publisher.PublishToUsers([]uuid.UUID{contactID}, websocket.MessageTypeContactAccepted, userID, contact)
+	} else {
+		request, err := s.get(own.ID, "User")
+		if err != nil {
+			return nil, err
+		}
+		s.publisher.PublishToUsers([]uuid.UUID{contactID}, websocket.MessageTypeContactRequest, userID, request)
+	}
+	return contact, nil
+}
+
+// Accept accepts the pending request requesterID sent to userID
+func (s *Service) Accept(userID, requesterID uuid.UUID) (*models.Contact, error) {
+	var own *models.Contact
+	var request *models.Contact
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		mine, theirs, err := lockPair(tx, userID, requesterID)
+		if err != nil {
+			return err
+		}
+		if theirs == nil || theirs.Status != models.ContactStatusPending {
+			return ErrNoRequest
+		}
+		if err := tx.Model(theirs).Update("status", models.ContactStatusAccepted).Error; err != nil {
+			return err
+		}
+		request = theirs
+
+		if mine == nil {
+			own = &models.Contact{UserID: userID, ContactID: requesterID, Status: models.ContactStatusAccepted}
+			return tx.Create(own).Error
+		}
+		own = mine
+		return tx.Model(own).Update("status", models.ContactStatusAccepted).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accepted, err := s.get(request.ID, "Contact")
+	if err != nil {
+		return nil, err
+	}
+	s.publisher.PublishToUsers([]uuid.UUID{requesterID}, websocket.MessageTypeContactAccepted, userID, accepted)
+
+	return s.get(own.ID, "Contact")
+}
+
+// Decline turns down the pending request requesterID sent to userID. The
+// requester is not notified; their request simply stops being pending.
+func (s *Service) Decline(userID, requesterID uuid.UUID) error {
+	result := s.db.Model(&models.Contact{}).
+		Where("user_id = ? AND contact_id = ? AND status = ?", requesterID, userID, models.ContactStatusPending).
+		Update("status", models.ContactStatusDeclined)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoRequest
+	}
+	return nil
+}
+
+// Remove ends the relationship between userID and contactID on both sides,
+// which also withdraws a pending request. Blocks stay in place.
+func (s *Service) Remove(userID, contactID uuid.UUID) error {
+	wasContact := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		mine, theirs, err := lockPair(tx, userID, contactID)
+		if err != nil {
+			return err
+		}
+		if mine == nil || mine.Status == models.ContactStatusNone {
+			return ErrNotFound
+		}
+		wasContact = mine.Status == models.ContactStatusAccepted
+
+		for _, row := range []*models.Contact{mine, theirs} {
+			if err := detach(tx, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if wasContact {
+		s.publisher.PublishToUsers([]uuid.UUID{contactID}, websocket.MessageTypeContactRemoved, userID,
+			map[string]interface{}{"user_id": userID})
+	}
+	return nil
+}
+
+// SetNickname changes the name userID sees for one of their contacts
+func (s *Service) SetNickname(userID, contactID uuid.UUID, nickname string) (*models.Contact, error) {
+	var contact models.Contact
+	err := s.db.Where("user_id = ? AND contact_id = ? AND status = ?", userID, contactID, models.ContactStatusAccepted).
+		First(&contact).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	if err := s.db.Model(&contact).Update("nickname", nickname).Error; err != nil {
+		return nil, err
+	}
+	return s.get(contact.ID, "Contact")
+}
+
+// Block stops targetID from messaging or calling userID and from seeing
+// their presence. Pending requests between the two are dropped; an existing
+// contact is kept and comes back on Unblock.
+func (s *Service) Block(userID, targetID uuid.UUID) (*models.Contact, error) {
+	if userID == targetID {
+		return nil, ErrInvalidUser
+	}
+
+	var exists int64
+	if err := s.db.Model(&models.User{}).Where("id = ?", targetID).Count(&exists).Error; err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, ErrInvalidUser
+	}
+
+	var own *models.Contact
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		mine, theirs, err := lockPair(tx, userID, targetID)
+		if err != nil {
+			return err
+		}
+
+		if theirs != nil && theirs.Status == models.ContactStatusPending {
+			if err := tx.Model(theirs).Update("status", models.ContactStatusDeclined).Error; err != nil {
+				return err
+			}
+		}
+
+		if mine == nil {
+			own = &models.Contact{UserID: userID, ContactID: targetID, Status: models.ContactStatusNone, IsBlocked: true}
+			return tx.Create(own).Error
+		}
+
+		updates := map[string]interface{}{"is_blocked": true}
+		if mine.Status == models.ContactStatusPending || mine.Status == models.ContactStatusDeclined {
+			updates["status"] = models.ContactStatusNone
+		}
+		own = mine
+		return tx.Model(own).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.get(own.ID, "Contact")
+}
+
+// Unblock lifts a block userID placed on targetID
+func (s *Service) Unblock(userID, targetID uuid.UUID) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var contact models.Contact
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND contact_id = ? AND is_blocked = ?", userID, targetID, true).
+			First(&contact).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if contact.Status == models.ContactStatusNone {
+			return tx.Delete(&contact).Error
+		}
+		return tx.Model(&contact).Update("is_blocked", false).Error
+	})
+}
+
+// IsBlocked reports whether either user blocked the other
+func (s *Service) IsBlocked(userID, otherID uuid.UUID) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.Contact{}).
+		Where("is_blocked = ? AND ((user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?))",
+			true, userID, otherID, otherID, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// IsBlockedBy reports whether blockerID blocked userID
+func (s *Service) IsBlockedBy(userID, blockerID uuid.UUID) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.Contact{}).
+		Where("user_id = ? AND contact_id = ? AND is_blocked = ?", blockerID, userID, true).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// BlockedIDs returns the users userID blocked or was blocked by
+func (s *Service) BlockedIDs(userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := s.db.Raw(`SELECT contact_id FROM contacts WHERE user_id = ? AND is_blocked = ?
+		UNION SELECT user_id FROM contacts WHERE contact_id = ? AND is_blocked = ?`,
+		userID, true, userID, true).
+		Scan(&ids).Error
+	return ids, err
+}
+
+func (s *Service) get(id uuid.UUID, preload string) (*models.Contact, error) {
+	var contact models.Contact
+	if err := s.db.Preload(preload).Where("id = ?", id).First(&contact).Error; err != nil {
+		return nil, err
+	}
+	return &contact, nil
+}
+
+// lockPair locks both users in a fixed order, so concurrent requests between
+// the same two people run one at a time, and loads the row each of them
+// owns about the other
+func lockPair(tx *gorm.DB, userID, otherID uuid.UUID) (*models.Contact, *models.Contact, error) {
+	var users []models.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		Where("id IN ?", []uuid.UUID{userID, otherID}).
+		Order("id").
+		Find(&users).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []models.Contact
+	err = tx.Where("(user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?)",
+		userID, otherID, otherID, userID).
+		Find(&rows).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mine, theirs *models.Contact
+	for i := range rows {
+		if rows[i].UserID == userID {
+			mine = &rows[i]
+		} else {
+			theirs = &rows[i]
+		}
+	}
+	return mine, theirs, nil
+}
+
+// detach drops the relationship a row records but keeps its block
+func detach(tx *gorm.DB, row *models.Contact) error {
+	if row == nil {
+		return nil
+	}
+	if row.IsBlocked {
+		return tx.Model(row).Updates(map[string]interface{}{"status": models.ContactStatusNone, "nickname": ""}).Error
+	}
+	return tx.Delete(row).Error
+}
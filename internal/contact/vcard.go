@@ -0,0 +1,135 @@
+package contact
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"messenger/pkg/models"
+)
+
+// Card is what an import needs from one vCard
+type Card struct {
+	Name   string
+	Emails []string
+}
+
+// ParseVCards reads the cards of a vCard 2.1, 3.0 or 4.0 file. Only the
+// formatted name and email addresses are kept; cards without an email are
+// skipped.
+func ParseVCards(r io.Reader) ([]Card, error) {
+	lines, err := unfoldLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cards []Card
+	var card *Card
+	for _, line := range lines {
+		name, value, ok := splitProperty(line)
+		if !ok {
+			continue
+		}
+
+		switch name {
+		case "BEGIN":
+			if strings.EqualFold(value, "VCARD") {
+				card = &Card{}
+			}
+		case "END":
+			if strings.EqualFold(value, "VCARD") && card != nil {
+				if len(card.Emails) > 0 {
+					cards = append(cards, *card)
+				}
+				card = nil
+			}
+		case "FN":
+			if card != nil {
+				card.Name = unescapeValue(value)
+			}
+		case "EMAIL":
+			if card != nil {
+				if email := NormalizeEmail(strings.TrimPrefix(unescapeValue(value), "mailto:")); email != "" {
+					card.Emails = append(card.Emails, email)
+				}
+			}
+		}
+	}
+	return cards, nil
+}
+
+// WriteVCards writes contacts as a vCard 3.0 file. The nickname, when set,
+// is used as the formatted name.
+func WriteVCards(w io.Writer, contacts []models.Contact) error {
+	buf := bufio.NewWriter(w)
+	for _, contact := range contacts {
+		user := contact.Contact
+		name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+		if name == "" {
+			name = user.Username
+		}
+		formatted := name
+		if contact.Nickname != "" {
+			formatted = contact.Nickname
+		}
+
+		fmt.Fprint(buf, "BEGIN:VCARD\r\n")
+		fmt.Fprint(buf, "VERSION:3.0\r\n")
+		fmt.Fprintf(buf, "UID:urn:uuid:%s\r\n", user.ID)
+		fmt.Fprintf(buf, "FN:%s\r\n", escapeValue(formatted))
+		fmt.Fprintf(buf, "N:%s;%s;;;\r\n", escapeValue(user.LastName), escapeValue(user.FirstName))
+		fmt.Fprintf(buf, "NICKNAME:%s\r\n", escapeValue(user.Username))
+		if user.Email != "" {
+			fmt.Fprintf(buf, "EMAIL;TYPE=INTERNET:%s\r\n", escapeValue(user.Email))
+		}
+		fmt.Fprint(buf, "END:VCARD\r\n")
+	}
+	return buf.Flush()
+}
+
+// unfoldLines joins continuation lines, which start with a space or a tab,
+// onto the line before them
+func unfoldLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// splitProperty splits "group.NAME;PARAM=x:value" into the upper-cased
+// property name and its value
+func splitProperty(line string) (string, string, bool) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return "", "", false
+	}
+
+	name := line[:colon]
+	if semicolon := strings.Index(name, ";"); semicolon >= 0 {
+		name = name[:semicolon]
+	}
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		name = name[dot+1:]
+	}
+	return strings.ToUpper(strings.TrimSpace(name)), strings.TrimSpace(line[colon+1:]), true
+}
+
+var (
+	valueEscaper   = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`, "\r", "")
+	valueUnescaper = strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, "\n", `\N`, "\n")
+)
+
+func escapeValue(value string) string {
+	return valueEscaper.Replace(value)
+}
+
+func unescapeValue(value string) string {
+	return valueUnescaper.Replace(value)
+}
@@ -10,6 +10,11 @@ import (
 	"gorm.io/gorm/logger"
 )
 
+// SearchConfig is the text search configuration used for message search.
+// "simple" does no stemming, which works the same for every language users
+// write in. Queries must use the same expression as the index below.
+const SearchConfig = "simple"
+
 type Database struct {
 	DB *gorm.DB
 }
@@ -51,14 +56,19 @@ func (d *Database) AutoMigrate() error {
 	err := d.DB.AutoMigrate(
 		&models.User{},
 		&models.UserSession{},
+		&models.UserToken{},
 		&models.Contact{},
+		&models.ContactMatchUsage{},
 		&models.Chat{},
 		&models.ChatMember{},
 		&models.ChatSettings{},
 		&models.ChatInvite{},
 		&models.Message{},
 		&models.MessageRead{},
+		&models.MessageDelivery{},
+		&models.DirectReadCursor{},
 		&models.File{},
+		&models.UploadSession{},
 		&models.Reaction{},
 		&models.Call{},
 		&models.CallParticipant{},
@@ -68,6 +78,15 @@ func (d *Database) AutoMigrate() error {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	// Full-text index for message search
+	err = d.DB.Exec(fmt.Sprintf(
+		"CREATE INDEX IF NOT EXISTS idx_messages_content_search ON messages USING GIN (to_tsvector('%s', content))",
+		SearchConfig,
+	)).Error
+	if err != nil {
+		return fmt.Errorf("failed to create search index: %w", err)
+	}
+
 	log.Println("Database migrations completed successfully")
 	return nil
 }
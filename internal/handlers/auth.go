@@ -1,19 +1,23 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"messenger/internal/auth"
+	"messenger/internal/websocket"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
 type AuthHandler struct {
 	authService *auth.Service
+	sessions    websocket.SessionCloser
 }
 
-func NewAuthHandler(authService *auth.Service) *AuthHandler {
+func NewAuthHandler(authService *auth.Service, sessions websocket.SessionCloser) *AuthHandler {
 	return &AuthHandler{
 		authService: authService,
+		sessions:    sessions,
 	}
 }
 
@@ -24,7 +28,11 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.Register(req)
+	if req.DeviceName == "" {
+		req.DeviceName = c.Request.UserAgent()
+	}
+
+	response, err := h.authService.Register(req, c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -40,7 +48,11 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.Login(req)
+	if req.DeviceName == "" {
+		req.DeviceName = c.Request.UserAgent()
+	}
+
+	response, err := h.authService.Login(req, c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
@@ -49,20 +61,281 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
-func (h *AuthHandler) Logout(c *gin.Context) {
-	userID := c.GetString("user_id")
-	token := c.GetString("token")
+// Refresh обменивает refresh token на новую пару токенов. Каждый refresh token
+// одноразовый; повторное использование отзывает всю сессию.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	parsedUserID, err := uuid.Parse(userID)
+	tokens, err := h.authService.Refresh(req.RefreshToken, c.ClientIP())
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		var reuse *auth.ReuseError
+		switch {
+		case errors.As(err, &reuse):
+			h.sessions.CloseSessions(reuse.UserID, []uuid.UUID{reuse.SessionID})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected, session revoked"})
+		case errors.Is(err, auth.ErrInvalidRefreshToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (h *AuthHandler) Logout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	if err := h.authService.Logout(parsedUserID, token); err != nil {
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	sessionID, _ := c.Get("session_id")
+	sessionUUID, _ := sessionID.(uuid.UUID)
+
+	if err := h.authService.Logout(userUUID, sessionUUID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.sessions.CloseSessions(userUUID, []uuid.UUID{sessionUUID})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
-}
\ No newline at end of file
+}
+
+// GetSessions возвращает устройства, с которых выполнен вход. Текущая сессия
+// помечена полем current.
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	sessionID, _ := c.Get("session_id")
+	sessionUUID, _ := sessionID.(uuid.UUID)
+
+	sessions, err := h.authService.Sessions(userUUID, sessionUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession завершает одну сессию по её family_id и сразу отключает
+// WebSocket-соединения этого устройства
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	sessionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	if err := h.authService.RevokeSession(userUUID, sessionID); err != nil {
+		if errors.Is(err, auth.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	h.sessions.CloseSessions(userUUID, []uuid.UUID{sessionID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeOtherSessions завершает все сессии пользователя, кроме текущей
+func (h *AuthHandler) RevokeOtherSessions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	sessionID, _ := c.Get("session_id")
+	sessionUUID, _ := sessionID.(uuid.UUID)
+
+	revoked, err := h.authService.RevokeOtherSessions(userUUID, sessionUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	h.sessions.CloseSessions(userUUID, revoked)
+
+	c.JSON(http.StatusOK, gin.H{"revoked": len(revoked)})
+}
+
+// VerifyEmail подтверждает email по токену из письма
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.VerifyEmail(req.Token); err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// ResendVerification повторно отправляет письмо для подтверждения email
+func (h *AuthHandler) ResendVerification(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	if err := h.authService.SendVerification(userUUID); err != nil {
+		switch {
+		case errors.Is(err, auth.ErrEmailVerified):
+			c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+		case errors.Is(err, auth.ErrTooManyRequests):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Verification email was sent recently, try again later"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent"})
+}
+
+// ForgotPassword отправляет ссылку для сброса пароля. Ответ одинаковый для
+// любого email, чтобы по нему нельзя было узнать, есть ли такой аккаунт.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.RequestPasswordReset(req.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request password reset"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the email is registered, a reset link has been sent"})
+}
+
+// ResetPassword устанавливает новый пароль по токену из письма и завершает
+// все сессии пользователя
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=6"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, revoked, err := h.authService.ResetPassword(req.Token, req.Password)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	h.sessions.CloseSessions(userID, revoked)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
+
+// ChangePassword меняет пароль текущего пользователя. Требует текущий пароль
+// и завершает все остальные сессии.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required,min=6"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionID, _ := c.Get("session_id")
+	sessionUUID, _ := sessionID.(uuid.UUID)
+
+	revoked, err := h.authService.ChangePassword(userUUID, sessionUUID, req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		if errors.Is(err, auth.ErrWrongPassword) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Current password is incorrect"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	h.sessions.CloseSessions(userUUID, revoked)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed", "revoked": len(revoked)})
+}
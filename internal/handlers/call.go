@@ -1,40 +1,446 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"messenger/internal/call"
 	"messenger/pkg/models"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type CallHandler struct {
-	// TODO: Add call service dependency
+	calls *call.Service
 }
 
-func NewCallHandler() *CallHandler {
-	return &CallHandler{}
+// InitiateCallRequest - запрос на звонок пользователю
+type InitiateCallRequest struct {
+	CalleeID      uuid.UUID       `json:"callee_id" binding:"required"`
+	ChatID        *uuid.UUID      `json:"chat_id"`
+	Type          models.CallType `json:"type"`
+	IsScreenShare bool            `json:"is_screen_share"`
 }
 
+// StartGroupCallRequest - запрос на групповой звонок в чате
+type StartGroupCallRequest struct {
+	ChatID uuid.UUID       `json:"chat_id" binding:"required"`
+	Type   models.CallType `json:"type"`
+}
+
+// UpdateCallMediaRequest - состояние микрофона и камеры участника; пустые поля не меняются
+type UpdateCallMediaRequest struct {
+	IsMuted   *bool `json:"is_muted"`
+	IsVideoOn *bool `json:"is_video_on"`
+}
+
+func NewCallHandler(calls *call.Service) *CallHandler {
+	return &CallHandler{
+		calls: calls,
+	}
+}
+
+// GetCalls возвращает историю звонков пользователя, новые первыми.
+// Фильтры: type, status; пагинация: limit, offset.
 func (h *CallHandler) GetCalls(c *gin.Context) {
-	// TODO: Implement get calls
-	c.JSON(http.StatusOK, gin.H{"calls": []models.Call{}})
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	filter := call.Filter{
+		Type:   models.CallType(c.Query("type")),
+		Status: models.CallStatus(c.Query("status")),
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	calls, hasMore, err := h.calls.History(userUUID, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch calls"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"calls":    calls,
+		"has_more": hasMore,
+	})
 }
 
+// InitiateCall начинает звонок; собеседник получает событие call_updated со статусом ringing
 func (h *CallHandler) InitiateCall(c *gin.Context) {
-	// TODO: Implement initiate call
-	c.JSON(http.StatusCreated, gin.H{"message": "Call initiated"})
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req InitiateCallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Type == "" {
+		req.Type = models.CallTypeVoice
+	}
+	if req.Type != models.CallTypeVoice && req.Type != models.CallTypeVideo {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be voice or video"})
+		return
+	}
+
+	record, err := h.calls.Initiate(userUUID, req.CalleeID, req.Type, req.IsScreenShare, req.ChatID)
+	if err != nil {
+		respondCallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"call": record})
+}
+
+// StartGroupCall начинает групповой звонок в чате. Если в чате уже идет звонок,
+// возвращается 409 вместе с ним, чтобы клиент мог присоединиться.
+func (h *CallHandler) StartGroupCall(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req StartGroupCallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Type == "" {
+		req.Type = models.CallTypeVoice
+	}
+	if req.Type != models.CallTypeVoice && req.Type != models.CallTypeVideo {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be voice or video"})
+		return
+	}
+
+	record, err := h.calls.StartGroup(userUUID, req.ChatID, req.Type)
+	if errors.Is(err, call.ErrCallInProgress) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "A group call is already in progress in this chat",
+			"call":  record,
+		})
+		return
+	}
+	if err != nil {
+		respondCallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"call": record})
+}
+
+// JoinCall подключает к групповому звонку
+func (h *CallHandler) JoinCall(c *gin.Context) {
+	h.changeCall(c, h.calls.Join)
+}
+
+// LeaveCall выходит из группового звонка; звонок завершается, когда уходит последний участник
+func (h *CallHandler) LeaveCall(c *gin.Context) {
+	h.changeCall(c, h.calls.Leave)
+}
+
+// UpdateCallMedia меняет состояние микрофона и камеры текущего пользователя
+func (h *CallHandler) UpdateCallMedia(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	callID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid call ID"})
+		return
+	}
+
+	var req UpdateCallMediaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	participant, err := h.calls.UpdateMedia(callID, userUUID, req.IsMuted, req.IsVideoOn)
+	if err != nil {
+		respondCallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"participant": participant})
+}
+
+// MuteCallParticipant выключает микрофон другому участнику (для модераторов)
+func (h *CallHandler) MuteCallParticipant(c *gin.Context) {
+	callID, targetID, moderatorID, ok := h.moderationParams(c)
+	if !ok {
+		return
+	}
+
+	participant, err := h.calls.MuteParticipant(callID, moderatorID, targetID)
+	if err != nil {
+		respondCallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"participant": participant})
 }
 
+// RemoveCallParticipant удаляет участника из звонка (для модераторов)
+func (h *CallHandler) RemoveCallParticipant(c *gin.Context) {
+	callID, targetID, moderatorID, ok := h.moderationParams(c)
+	if !ok {
+		return
+	}
+
+	record, err := h.calls.RemoveParticipant(callID, moderatorID, targetID)
+	if err != nil {
+		respondCallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"call": record})
+}
+
+// moderationParams читает :id, :user_id и текущего пользователя
+func (h *CallHandler) moderationParams(c *gin.Context) (callID, targetID, moderatorID uuid.UUID, ok bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	moderatorID, ok = userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var err error
+	if callID, err = uuid.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid call ID"})
+		return callID, targetID, moderatorID, false
+	}
+	if targetID, err = uuid.Parse(c.Param("user_id")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return callID, targetID, moderatorID, false
+	}
+	return callID, targetID, moderatorID, true
+}
+
+// GetCallSettings возвращает настройки звонков текущего пользователя
+func (h *CallHandler) GetCallSettings(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	settings, err := h.calls.Settings(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch call settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": settings})
+}
+
+// UpdateCallSettings меняет настройки звонков; поля, которых нет в запросе, не меняются
+func (h *CallHandler) UpdateCallSettings(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req call.SettingsUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	settings, err := h.calls.UpdateSettings(userUUID, &req)
+	if err != nil {
+		if errors.Is(err, call.ErrInvalidSettings) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "call_quality must be one of auto, low, medium, high"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update call settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": settings})
+}
+
+// SetScreenShare включает или выключает демонстрацию экрана: {"enabled": true}
+func (h *CallHandler) SetScreenShare(c *gin.Context) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.changeCall(c, func(callID, userID uuid.UUID) (*models.Call, error) {
+		return h.calls.SetScreenShare(callID, userID, req.Enabled)
+	})
+}
+
+// GetICEServers возвращает STUN/TURN серверы для RTCPeerConnection с временными
+// учетными данными TURN
+func (h *CallHandler) GetICEServers(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	// Учетные данные персональные, кэшировать их нельзя
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, h.calls.ICEServers(userUUID))
+}
+
+// AnswerCall принимает входящий звонок
 func (h *CallHandler) AnswerCall(c *gin.Context) {
-	// TODO: Implement answer call
-	c.JSON(http.StatusOK, gin.H{"message": "Call answered"})
+	h.changeCall(c, h.calls.Answer)
 }
 
+// RejectCall отклоняет входящий звонок
 func (h *CallHandler) RejectCall(c *gin.Context) {
-	// TODO: Implement reject call
-	c.JSON(http.StatusOK, gin.H{"message": "Call rejected"})
+	h.changeCall(c, h.calls.Reject)
 }
 
+// EndCall завершает звонок. С {"failed": true} звонок помечается как неудавшийся.
 func (h *CallHandler) EndCall(c *gin.Context) {
-	// TODO: Implement end call
-	c.JSON(http.StatusOK, gin.H{"message": "Call ended"})
-}
\ No newline at end of file
+	var req struct {
+		Failed bool `json:"failed"`
+	}
+	// Тело необязательное
+	c.ShouldBindJSON(&req)
+
+	if req.Failed {
+		h.changeCall(c, h.calls.Fail)
+		return
+	}
+	h.changeCall(c, h.calls.End)
+}
+
+// changeCall применяет переход состояния к звонку :id от имени текущего пользователя
+func (h *CallHandler) changeCall(c *gin.Context, change func(callID, userID uuid.UUID) (*models.Call, error)) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	callID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid call ID"})
+		return
+	}
+
+	record, err := change(callID, userUUID)
+	if err != nil {
+		respondCallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"call": record})
+}
+
+// respondCallError переводит ошибки сервиса звонков в HTTP ответы
+func respondCallError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, call.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call not found"})
+	case errors.Is(err, call.ErrNotParticipant):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this call"})
+	case errors.Is(err, call.ErrNotMember):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Both users must be members of the chat"})
+	case errors.Is(err, call.ErrInvalidCallee):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid callee"})
+	case errors.Is(err, call.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot call this user"})
+	case errors.Is(err, call.ErrBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": "User is busy with another call"})
+	case errors.Is(err, call.ErrVoiceCallsDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Voice calls are not allowed"})
+	case errors.Is(err, call.ErrVideoCallsDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Video calls are not allowed"})
+	case errors.Is(err, call.ErrScreenShareDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Screen sharing is not allowed"})
+	case errors.Is(err, call.ErrNotModerator):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only moderators can do this"})
+	case errors.Is(err, call.ErrNotGroupCall):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not a group call"})
+	case errors.Is(err, call.ErrInvalidTransition):
+		c.JSON(http.StatusConflict, gin.H{"error": "Call cannot be changed in its current state"})
+	default:
+		log.Printf("Call operation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update call"})
+	}
+}
@@ -7,17 +7,27 @@ import (
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 
-	"skytalk/internal/db"
-	"skytalk/pkg/models"
+	"messenger/internal/db"
+	"messenger/internal/receipt"
+	"messenger/pkg/models"
 )
 
 type ChatHandler struct {
-	db *db.Database
+	db       *db.Database
+	receipts *receipt.Service
 }
 
-func NewChatHandler(database *db.Database) *ChatHandler {
+// chatWithUnread - чат вместе с позицией чтения текущего пользователя
+type chatWithUnread struct {
+	models.Chat
+	UnreadCount       int64      `json:"unread_count"`
+	LastReadMessageID *uuid.UUID `json:"last_read_message_id"`
+}
+
+func NewChatHandler(database *db.Database, receipts *receipt.Service) *ChatHandler {
 	return &ChatHandler{
-		db: database,
+		db:       database,
+		receipts: receipts,
 	}
 }
 
@@ -80,10 +90,22 @@ func (h *ChatHandler) GetChats(c *gin.Context) {
 		}
 	}
 
+	// Считаем непрочитанные одним запросом для всех чатов
+	unread, err := h.receipts.ChatUnreadCounts(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread messages"})
+		return
+	}
+
 	// Преобразуем map в slice
-	chats := make([]models.Chat, 0, len(chatMap))
+	chats := make([]chatWithUnread, 0, len(chatMap))
 	for _, chat := range chatMap {
-		chats = append(chats, chat)
+		count := unread[chat.ID]
+		chats = append(chats, chatWithUnread{
+			Chat:              chat,
+			UnreadCount:       count.UnreadCount,
+			LastReadMessageID: count.LastReadMessageID,
+		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{"chats": chats})
@@ -1,40 +1,452 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"messenger/pkg/models"
+	"strings"
+	"messenger/internal/contact"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type ContactHandler struct {
-	// TODO: Add contact service dependency
+	contacts *contact.Service
 }
 
-func NewContactHandler() *ContactHandler {
-	return &ContactHandler{}
+// AddContactRequest - запрос на добавление в контакты
+type AddContactRequest struct {
+	ContactID uuid.UUID `json:"contact_id" binding:"required"`
+	Nickname  string    `json:"nickname" binding:"max=100"`
 }
 
+// UpdateContactRequest - новое имя контакта; пустая строка сбрасывает его
+type UpdateContactRequest struct {
+	Nickname string `json:"nickname" binding:"max=100"`
+}
+
+// MatchContactsRequest - адреса email и/или их хеши (hex SHA-256 от email в
+// нижнем регистре без пробелов по краям); add - сразу отправить заявки найденным
+type MatchContactsRequest struct {
+	Emails []string `json:"emails"`
+	Hashes []string `json:"hashes"`
+	Add    bool     `json:"add"`
+}
+
+// maxVCardSize - максимальный размер импортируемого файла vCard
+const maxVCardSize = 1 << 20
+
+func NewContactHandler(contacts *contact.Service) *ContactHandler {
+	return &ContactHandler{
+		contacts: contacts,
+	}
+}
+
+// GetContacts возвращает принятые контакты текущего пользователя, включая заблокированных
 func (h *ContactHandler) GetContacts(c *gin.Context) {
-	// TODO: Implement get contacts
-	c.JSON(http.StatusOK, gin.H{"contacts": []models.Contact{}})
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	contacts, err := h.contacts.List(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"contacts": contacts})
+}
+
+// GetContactRequests возвращает входящие и исходящие заявки в контакты
+func (h *ContactHandler) GetContactRequests(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	requests, err := h.contacts.Requests(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contact requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+// GetBlockedContacts возвращает пользователей, заблокированных текущим пользователем
+func (h *ContactHandler) GetBlockedContacts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	blocked, err := h.contacts.Blocked(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch blocked users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"contacts": blocked})
 }
 
+// AddContact отправляет заявку в контакты. Если собеседник уже прислал заявку
+// текущему пользователю, контакт сразу становится принятым.
 func (h *ContactHandler) AddContact(c *gin.Context) {
-	// TODO: Implement add contact
-	c.JSON(http.StatusCreated, gin.H{"message": "Contact added"})
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req AddContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record, err := h.contacts.Add(userUUID, req.ContactID, req.Nickname)
+	if err != nil {
+		respondContactError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"contact": record})
+}
+
+// UpdateContact меняет имя, под которым текущий пользователь видит контакт
+func (h *ContactHandler) UpdateContact(c *gin.Context) {
+	userUUID, contactID, ok := contactParams(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record, err := h.contacts.SetNickname(userUUID, contactID, req.Nickname)
+	if err != nil {
+		respondContactError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"contact": record})
 }
 
+// AcceptContact принимает заявку пользователя :id
+func (h *ContactHandler) AcceptContact(c *gin.Context) {
+	userUUID, requesterID, ok := contactParams(c)
+	if !ok {
+		return
+	}
+
+	record, err := h.contacts.Accept(userUUID, requesterID)
+	if err != nil {
+		respondContactError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"contact": record})
+}
+
+// DeclineContact отклоняет заявку пользователя :id
+func (h *ContactHandler) DeclineContact(c *gin.Context) {
+	userUUID, requesterID, ok := contactParams(c)
+	if !ok {
+		return
+	}
+
+	if err := h.contacts.Decline(userUUID, requesterID); err != nil {
+		respondContactError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contact request declined"})
+}
+
+// RemoveContact удаляет контакт у обеих сторон или отзывает отправленную заявку
 func (h *ContactHandler) RemoveContact(c *gin.Context) {
-	// TODO: Implement remove contact
+	userUUID, contactID, ok := contactParams(c)
+	if !ok {
+		return
+	}
+
+	if err := h.contacts.Remove(userUUID, contactID); err != nil {
+		respondContactError(c, err)
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Contact removed"})
 }
 
+// BlockContact блокирует пользователя :id: он не может писать в личные сообщения,
+// звонить и видеть статус текущего пользователя
 func (h *ContactHandler) BlockContact(c *gin.Context) {
-	// TODO: Implement block contact
-	c.JSON(http.StatusOK, gin.H{"message": "Contact blocked"})
+	userUUID, targetID, ok := contactParams(c)
+	if !ok {
+		return
+	}
+
+	record, err := h.contacts.Block(userUUID, targetID)
+	if err != nil {
+		respondContactError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"contact": record})
 }
 
+// UnblockContact снимает блокировку с пользователя :id
 func (h *ContactHandler) UnblockContact(c *gin.Context) {
-	// TODO: Implement unblock contact
-	c.JSON(http.StatusOK, gin.H{"message": "Contact unblocked"})
-}
\ No newline at end of file
+	userUUID, targetID, ok := contactParams(c)
+	if !ok {
+		return
+	}
+
+	if err := h.contacts.Unblock(userUUID, targetID); err != nil {
+		respondContactError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked"})
+}
+
+// MatchContacts ищет пользователей по списку email или хешей email. Для хешей
+// адреса в ответе не возвращаются. Число проверяемых адресов и хешей в сутки
+// ограничено; сверх лимита отвечаем 429.
+func (h *ContactHandler) MatchContacts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req MatchContactsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Emails)+len(req.Hashes) > contact.MaxMatchBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d emails and hashes per request", contact.MaxMatchBatch)})
+		return
+	}
+
+	matches, err := h.contacts.Match(userUUID, req.Emails, req.Hashes)
+	if err != nil {
+		respondMatchError(c, err)
+		return
+	}
+
+	if req.Add {
+		if err := h.contacts.AddMatches(userUUID, matches, nil); err != nil {
+			respondContactError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"matches": matches})
+}
+
+// ImportContacts импортирует файл vCard (поле file формы или тело запроса с типом
+// text/vcard): найденным по email пользователям отправляются заявки, имя из карточки
+// становится именем контакта. unmatched - адреса, для которых пользователей нет.
+func (h *ContactHandler) ImportContacts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxVCardSize+(1<<10))
+
+	var source io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, _, err := c.Request.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "vCard file is required"})
+			return
+		}
+		defer file.Close()
+		source = file
+	}
+
+	cards, err := contact.ParseVCards(io.LimitReader(source, maxVCardSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid vCard file"})
+		return
+	}
+
+	var emails []string
+	names := make(map[string]string)
+	for _, card := range cards {
+		for _, email := range card.Emails {
+			emails = append(emails, email)
+			if _, ok := names[email]; !ok {
+				names[email] = card.Name
+			}
+		}
+	}
+	if len(emails) > contact.MaxMatchBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d emails per import", contact.MaxMatchBatch)})
+		return
+	}
+
+	matches, err := h.contacts.Match(userUUID, emails, nil)
+	if err != nil {
+		respondMatchError(c, err)
+		return
+	}
+
+	nicknames := make(map[uuid.UUID]string, len(matches))
+	matched := make(map[string]bool, len(matches))
+	for _, match := range matches {
+		matched[match.Email] = true
+		if _, ok := nicknames[match.User.ID]; !ok {
+			nicknames[match.User.ID] = names[match.Email]
+		}
+	}
+
+	if err := h.contacts.AddMatches(userUUID, matches, nicknames); err != nil {
+		respondContactError(c, err)
+		return
+	}
+
+	unmatched := []string{}
+	for _, email := range emails {
+		if !matched[email] {
+			matched[email] = true
+			unmatched = append(unmatched, email)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cards":     len(cards),
+		"matches":   matches,
+		"unmatched": unmatched,
+	})
+}
+
+// ExportContacts отдает принятые контакты файлом vCard
+func (h *ContactHandler) ExportContacts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	contacts, err := h.contacts.List(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+
+	c.Header("Content-Type", "text/vcard; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="contacts.vcf"`)
+	c.Status(http.StatusOK)
+	if err := contact.WriteVCards(c.Writer, contacts); err != nil {
+		log.Printf("Failed to write vCard export: %v", err)
+	}
+}
+
+// contactParams читает текущего пользователя и :id - ID другого пользователя
+func contactParams(c *gin.Context) (userUUID, contactID uuid.UUID, ok bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok = userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	contactID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return userUUID, contactID, false
+	}
+
+	return userUUID, contactID, true
+}
+
+// respondContactError переводит ошибки сервиса контактов в HTTP ответы
+func respondMatchError(c *gin.Context, err error) {
+	if errors.Is(err, contact.ErrMatchLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Daily contact matching limit reached, try again tomorrow"})
+		return
+	}
+	log.Printf("Contact matching failed: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match contacts"})
+}
+
+func respondContactError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, contact.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+	case errors.Is(err, contact.ErrInvalidUser):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user"})
+	case errors.Is(err, contact.ErrAlreadyContact):
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already in contacts"})
+	case errors.Is(err, contact.ErrRequestPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "Contact request already sent"})
+	case errors.Is(err, contact.ErrNoRequest):
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending contact request"})
+	case errors.Is(err, contact.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is blocked"})
+	default:
+		log.Printf("Contact operation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update contacts"})
+	}
+}
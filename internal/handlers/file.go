@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"messenger/internal/db"
+	"messenger/internal/storage"
+	"messenger/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type FileHandler struct {
+	db      *db.Database
+	storage storage.Storage
+	signer  *storage.URLSigner
+}
+
+func NewFileHandler(database *db.Database, fileStorage storage.Storage, signer *storage.URLSigner) *FileHandler {
+	return &FileHandler{
+		db:      database,
+		storage: fileStorage,
+		signer:  signer,
+	}
+}
+
+// DownloadFile отдает содержимое файла с поддержкой Range запросов.
+// Доступ - по токену в заголовке Authorization или по подписанной ссылке
+// (параметры uid, expires, sig), чтобы файлы открывались в <img> и <video>.
+// С параметром download=1 файл отдается как вложение, с thumb=<name> - миниатюра
+// или кадр-обложка видео из списка thumbnails файла.
+func (h *FileHandler) DownloadFile(c *gin.Context) {
+	fileID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	var userUUID uuid.UUID
+	signed := c.Query("sig") != ""
+	if signed {
+		var valid bool
+		userUUID, valid = h.signer.Verify(fileID, c.Request.URL.Query())
+		if !valid {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+			return
+		}
+	} else {
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+		var ok bool
+		userUUID, ok = userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+			return
+		}
+	}
+
+	// Доступ проверяется и для подписанных ссылок: пользователь мог покинуть чат
+	record, ok := h.loadFile(c, userUUID, fileID)
+	if !ok {
+		return
+	}
+
+	path, mimeType, fileName := record.FilePath, record.MimeType, record.FileName
+	if name := c.Query("thumb"); name != "" {
+		thumbnail := findThumbnail(record, name)
+		if thumbnail == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnail not found"})
+			return
+		}
+		path, mimeType = thumbnail.Path, thumbnail.MimeType
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + "_" + thumbnail.Name + ".jpg"
+	}
+
+	content, err := h.storage.Open(c.Request.Context(), path)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File content not found"})
+		} else {
+			log.Printf("Failed to open %s: %v", path, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		}
+		return
+	}
+	defer content.Close()
+
+	disposition := "inline"
+	if download, _ := strconv.ParseBool(c.Query("download")); download {
+		disposition = "attachment"
+	}
+
+	c.Header("Content-Type", mimeType)
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age=300")
+
+	// ServeContent обрабатывает Range, If-Range и If-Modified-Since
+	http.ServeContent(c.Writer, c.Request, fileName, record.UpdatedAt, content)
+}
+
+func findThumbnail(record *models.File, name string) *models.Thumbnail {
+	for i := range record.Thumbnails {
+		if record.Thumbnails[i].Name == name {
+			return &record.Thumbnails[i]
+		}
+	}
+	return nil
+}
+
+// GetFileURL выдает короткоживущую подписанную ссылку на файл
+func (h *FileHandler) GetFileURL(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	fileID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	record, ok := h.loadFile(c, userUUID, fileID)
+	if !ok {
+		return
+	}
+
+	query, expiresAt := h.signer.Sign(record.ID, userUUID)
+	c.JSON(http.StatusOK, gin.H{
+		"url":        "/api/v1/files/" + record.ID.String() + "?" + query.Encode(),
+		"expires_at": expiresAt,
+	})
+}
+
+// loadFile находит файл и проверяет, что пользователь видит сообщение, к
+// которому он прикреплен (те же правила, что и в GetMessage)
+func (h *FileHandler) loadFile(c *gin.Context, userID, fileID uuid.UUID) (*models.File, bool) {
+	var record models.File
+	if err := h.db.DB.Preload("Message").Where("id = ?", fileID).First(&record).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch file"})
+		}
+		return nil, false
+	}
+
+	// Файлы удаленных сообщений недоступны
+	if record.Message.ID == uuid.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+
+	message := record.Message
+	if message.ChatID != nil {
+		var member models.ChatMember
+		err := h.db.DB.Where("chat_id = ? AND user_id = ? AND is_active = ?", *message.ChatID, userID, true).
+			First(&member).Error
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this file"})
+			return nil, false
+		}
+	} else if message.ReceiverID != nil {
+		if message.SenderID != userID && *message.ReceiverID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this file"})
+			return nil, false
+		}
+	}
+
+	return &record, true
+}
@@ -1,26 +1,39 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"messenger/pkg/models"
+	"messenger/internal/contact"
 	"messenger/internal/db"
+	"messenger/internal/receipt"
+	"messenger/internal/websocket"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type MessageHandler struct {
-	db *db.Database
+	db        *db.Database
+	publisher websocket.Publisher
+	receipts  *receipt.Service
+	contacts  *contact.Service
 }
 
-func NewMessageHandler(database *db.Database) *MessageHandler {
+func NewMessageHandler(database *db.Database, publisher websocket.Publisher, receipts *receipt.Service, contacts *contact.Service) *MessageHandler {
 	return &MessageHandler{
-		db: database,
+		db:        database,
+		publisher: publisher,
+		receipts:  receipts,
+		contacts:  contacts,
 	}
 }
 
-// GetMessages возвращает сообщения для чата или пользователя
+// GetMessages возвращает страницу истории чата или личной переписки, новые сообщения первыми.
+// Параметры before, after и around принимают курсор или ID сообщения; around загружает
+// страницу вокруг сообщения (переход к результату поиска или к ответу).
 func (h *MessageHandler) GetMessages(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -38,26 +51,25 @@ func (h *MessageHandler) GetMessages(c *gin.Context) {
 	chatIDStr := c.Query("chat_id")
 	receiverIDStr := c.Query("receiver_id")
 	limitStr := c.DefaultQuery("limit", "50")
-	offsetStr := c.DefaultQuery("offset", "0")
 
 	limit, err := strconv.Atoi(limitStr)
 	if err != nil || limit <= 0 || limit > 100 {
 		limit = 50
 	}
 
-	offset, err := strconv.Atoi(offsetStr)
-	if err != nil || offset < 0 {
-		offset = 0
+	// Допускается только один из курсоров
+	modes := 0
+	for _, param := range []string{"before", "after", "around"} {
+		if c.Query(param) != "" {
+			modes++
+		}
+	}
+	if modes > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only one of before, after or around can be used"})
+		return
 	}
 
-	var messages []models.Message
-	query := h.db.DB.Preload("Sender").
-		Preload("Receiver").
-		Preload("Chat").
-		Preload("ReplyTo").
-		Preload("Files").
-		Preload("Reactions.User").
-		Order("created_at ASC")
+	var conversation func(db *gorm.DB) *gorm.DB
 
 	// Фильтруем по чату или получателю
 	if chatIDStr != "" {
@@ -94,7 +106,9 @@ func (h *MessageHandler) GetMessages(c *gin.Context) {
 			}
 		}
 
-		query = query.Where("chat_id = ?", chatID)
+		conversation = func(db *gorm.DB) *gorm.DB {
+			return db.Where("chat_id = ?", chatID)
+		}
 	} else if receiverIDStr != "" {
 		receiverID, err := uuid.Parse(receiverIDStr)
 		if err != nil {
@@ -103,20 +117,95 @@ func (h *MessageHandler) GetMessages(c *gin.Context) {
 		}
 
 		// Получаем сообщения между двумя пользователями
-		query = query.Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)",
-			userUUID, receiverID, receiverID, userUUID)
+		conversation = func(db *gorm.DB) *gorm.DB {
+			return db.Where("((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))",
+				userUUID, receiverID, receiverID, userUUID)
+		}
 	} else {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Either chat_id or receiver_id must be provided"})
 		return
 	}
 
-	err = query.Limit(limit).Offset(offset).Find(&messages).Error
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
-		return
+	query := func() *gorm.DB {
+		return h.db.DB.Preload("Sender").
+			Preload("Receiver").
+			Preload("Chat").
+			Preload("ReplyTo").
+			Preload("Files").
+			Preload("Reactions.User").
+			Scopes(conversation)
+	}
+
+	var page *MessagePage
+	switch {
+	case c.Query("before") != "":
+		cursor, ok := h.parseCursorParam(c, c.Query("before"), conversation)
+		if !ok {
+			return
+		}
+		messages, hasMore, err := olderThan(query(), &cursor, false, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+		page = newMessagePage(messages, hasMore, true)
+
+	case c.Query("after") != "":
+		cursor, ok := h.parseCursorParam(c, c.Query("after"), conversation)
+		if !ok {
+			return
+		}
+		messages, hasMore, err := newerThan(query(), cursor, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+		page = newMessagePage(messages, true, hasMore)
+
+	case c.Query("around") != "":
+		cursor, ok := h.parseCursorParam(c, c.Query("around"), conversation)
+		if !ok {
+			return
+		}
+		// Целевое сообщение входит в старшую половину страницы
+		newer, hasMoreAfter, err := newerThan(query(), cursor, limit/2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+		older, hasMoreBefore, err := olderThan(query(), &cursor, true, limit-len(newer))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+		page = newMessagePage(append(newer, older...), hasMoreBefore, hasMoreAfter)
+
+	default:
+		messages, hasMore, err := olderThan(query(), nil, false, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+		page = newMessagePage(messages, hasMore, false)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"messages": messages})
+	c.JSON(http.StatusOK, page)
+}
+
+// parseCursorParam разбирает курсор пагинации и отвечает клиенту при ошибке
+func (h *MessageHandler) parseCursorParam(c *gin.Context, value string, conversation func(db *gorm.DB) *gorm.DB) (messageCursor, bool) {
+	cursor, err := parseMessageCursor(value, h.db.DB.Model(&models.Message{}).Scopes(conversation))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		} else if err == errInvalidCursor {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message"})
+		}
+		return messageCursor{}, false
+	}
+	return cursor, true
 }
 
 // SendMessage отправляет новое сообщение
@@ -182,6 +271,19 @@ func (h *MessageHandler) SendMessage(c *gin.Context) {
 		}
 	}
 
+	// В личной переписке блокировка любой из сторон запрещает отправку
+	if request.ReceiverID != nil {
+		blocked, err := h.contacts.IsBlocked(userUUID, *request.ReceiverID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check block list"})
+			return
+		}
+		if blocked {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot message this user"})
+			return
+		}
+	}
+
 	// Если указан reply_to_id, проверяем существование сообщения
 	if request.ReplyToID != nil {
 		var replyMessage models.Message
@@ -227,6 +329,9 @@ func (h *MessageHandler) SendMessage(c *gin.Context) {
 		return
 	}
 
+	publishMessageEvent(h.publisher, websocket.MessageTypeNewMessage, userUUID, &message, message)
+	h.receipts.PublishUnreadCounts(&message)
+
 	c.JSON(http.StatusCreated, gin.H{"message": message})
 }
 
@@ -362,6 +467,8 @@ func (h *MessageHandler) UpdateMessage(c *gin.Context) {
 		return
 	}
 
+	publishMessageEvent(h.publisher, websocket.MessageTypeMessageUpdated, userUUID, &message, message)
+
 	c.JSON(http.StatusOK, gin.H{"message": message})
 }
 
@@ -428,9 +535,30 @@ func (h *MessageHandler) DeleteMessage(c *gin.Context) {
 		return
 	}
 
+	publishMessageEvent(h.publisher, websocket.MessageTypeMessageDeleted, userUUID, &message, websocket.MessageDeletedPayload{
+		ID:         message.ID,
+		ChatID:     message.ChatID,
+		ReceiverID: message.ReceiverID,
+	})
+	h.receipts.PublishUnreadCounts(&message)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Message deleted successfully"})
 }
 
+// publishMessageEvent рассылает событие участникам чата или обоим собеседникам
+func publishMessageEvent(publisher websocket.Publisher, eventType string, actorID uuid.UUID, message *models.Message, data interface{}) {
+	if message.ChatID != nil {
+		if err := publisher.PublishToChat(*message.ChatID, eventType, actorID, data); err != nil {
+			log.Printf("Failed to publish %s for message %s: %v", eventType, message.ID, err)
+		}
+		return
+	}
+
+	if message.ReceiverID != nil {
+		publisher.PublishToUsers([]uuid.UUID{message.SenderID, *message.ReceiverID}, eventType, actorID, data)
+	}
+}
+
 // MarkMessageAsRead отмечает сообщение как прочитанное
 func (h *MessageHandler) MarkMessageAsRead(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -484,35 +612,148 @@ func (h *MessageHandler) MarkMessageAsRead(c *gin.Context) {
 		return
 	}
 
-	// Проверяем, не отмечено ли уже сообщение как прочитанное
-	var existingRead models.MessageRead
-	err = h.db.DB.Where("message_id = ? AND user_id = ?", messageID, userUUID).
-		First(&existingRead).Error
+	// Записываем прочтение; статус сообщения пересчитывается по всем получателям,
+	// а отправитель получает событие message_read
+	if err := h.receipts.MarkRead(messageID, userUUID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark message as read"})
+		return
+	}
 
-	if err == nil {
-		// Уже отмечено как прочитанное
-		c.JSON(http.StatusOK, gin.H{"message": "Message already marked as read"})
+	c.JSON(http.StatusOK, gin.H{"message": "Message marked as read successfully"})
+}
+
+// GetMessageReceipts возвращает статус доставки и прочтения по каждому получателю
+func (h *MessageHandler) GetMessageReceipts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	// Создаем запись о прочтении
-	messageRead := models.MessageRead{
-		MessageID: messageID,
-		UserID:    userUUID,
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
 	}
 
-	err = h.db.DB.Create(&messageRead).Error
+	messageID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark message as read"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
 		return
 	}
 
-	// Обновляем статус сообщения
-	err = h.db.DB.Model(&message).Update("status", models.MessageStatusRead).Error
+	var message models.Message
+	err = h.db.DB.Where("id = ?", messageID).First(&message).Error
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message status"})
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message"})
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message marked as read successfully"})
-}
\ No newline at end of file
+	// Квитанции видит только отправитель
+	if message.SenderID != userUUID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can view receipts"})
+		return
+	}
+
+	receipts, err := h.receipts.GetReceipts(&message)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch receipts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message_id": message.ID,
+		"status":     message.Status,
+		"receipts":   receipts,
+	})
+}
+
+// MarkConversationReadRequest - запрос на отметку переписки прочитанной до сообщения
+type MarkConversationReadRequest struct {
+	ChatID     *uuid.UUID `json:"chat_id"`
+	ReceiverID *uuid.UUID `json:"receiver_id"`
+	MessageID  uuid.UUID  `json:"message_id" binding:"required"`
+}
+
+// MarkConversationRead отмечает прочитанными все сообщения чата или личной переписки до указанного
+func (h *MessageHandler) MarkConversationRead(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req MarkConversationReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// receiver_id здесь - собеседник в личной переписке
+	conversation := receipt.Conversation{ChatID: req.ChatID, PeerID: req.ReceiverID}
+	count, err := h.receipts.MarkReadUpTo(userUUID, conversation, req.MessageID)
+	if err != nil {
+		switch {
+		case errors.Is(err, receipt.ErrInvalidConversation):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Either chat_id or receiver_id must be specified"})
+		case errors.Is(err, receipt.ErrNotInConversation):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Message does not belong to this conversation"})
+		case errors.Is(err, receipt.ErrNotMember):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this chat"})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark conversation as read"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, count)
+}
+
+// GetUnreadCounts возвращает количество непрочитанных сообщений по чатам и личным перепискам
+func (h *MessageHandler) GetUnreadCounts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	chatCounts, err := h.receipts.ChatUnreadCounts(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread messages"})
+		return
+	}
+
+	directCounts, err := h.receipts.DirectUnreadCounts(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread messages"})
+		return
+	}
+
+	chats := make([]receipt.UnreadCount, 0, len(chatCounts))
+	for _, count := range chatCounts {
+		chats = append(chats, count)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"chats":  chats,
+		"direct": directCounts,
+	})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// messageCursor is a position in a conversation's history. Messages are
+// ordered by created_at and then by id so that positions are stable even
+// when several messages share a timestamp.
+type messageCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// MessagePage is one page of a conversation's history, newest first.
+// BeforeCursor and AfterCursor load the adjacent older and newer pages.
+type MessagePage struct {
+	Messages      []models.Message `json:"messages"`
+	HasMoreBefore bool             `json:"has_more_before"`
+	HasMoreAfter  bool             `json:"has_more_after"`
+	BeforeCursor  string           `json:"before_cursor,omitempty"`
+	AfterCursor   string           `json:"after_cursor,omitempty"`
+}
+
+func cursorOf(message *models.Message) messageCursor {
+	return messageCursor{CreatedAt: message.CreatedAt, ID: message.ID}
+}
+
+// encode returns the opaque form handed out to clients
+func (c messageCursor) encode() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + "_" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// parseMessageCursor accepts either an opaque cursor or a plain message id.
+// A message id is resolved to its position through scope, so only messages
+// of the requested conversation can be used as an anchor.
+func parseMessageCursor(value string, scope *gorm.DB) (messageCursor, error) {
+	if id, err := uuid.Parse(value); err == nil {
+		var message models.Message
+		if err := scope.Select("id", "created_at").Where("id = ?", id).First(&message).Error; err != nil {
+			return messageCursor{}, err
+		}
+		return cursorOf(&message), nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return messageCursor{}, errInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "_", 2)
+	if len(parts) != 2 {
+		return messageCursor{}, errInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return messageCursor{}, errInvalidCursor
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return messageCursor{}, errInvalidCursor
+	}
+	return messageCursor{CreatedAt: time.Unix(0, nanos), ID: id}, nil
+}
+
+// olderThan loads up to limit messages before the cursor, newest first. With
+// inclusive the cursor message itself is part of the page.
+func olderThan(query *gorm.DB, cursor *messageCursor, inclusive bool, limit int) ([]models.Message, bool, error) {
+	if cursor != nil {
+		op := "<"
+		if inclusive {
+			op = "<="
+		}
+		query = query.Where("(created_at, id) "+op+" (?, ?)", cursor.CreatedAt, cursor.ID)
+	}
+
+	var messages []models.Message
+	err := query.Order("created_at DESC, id DESC").Limit(limit + 1).Find(&messages).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return messages, hasMore, nil
+}
+
+// newerThan loads up to limit messages after the cursor, newest first
+func newerThan(query *gorm.DB, cursor messageCursor, limit int) ([]models.Message, bool, error) {
+	var messages []models.Message
+	err := query.Where("(created_at, id) > (?, ?)", cursor.CreatedAt, cursor.ID).
+		Order("created_at ASC, id ASC").
+		Limit(limit + 1).
+		Find(&messages).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, hasMore, nil
+}
+
+// newMessagePage fills in the cursors of a newest-first page
+func newMessagePage(messages []models.Message, hasMoreBefore, hasMoreAfter bool) *MessagePage {
+	page := &MessagePage{
+		Messages:      messages,
+		HasMoreBefore: hasMoreBefore,
+		HasMoreAfter:  hasMoreAfter,
+	}
+	if len(messages) > 0 {
+		page.AfterCursor = cursorOf(&messages[0]).encode()
+		page.BeforeCursor = cursorOf(&messages[len(messages)-1]).encode()
+	}
+	if page.Messages == nil {
+		page.Messages = []models.Message{}
+	}
+	return page
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"messenger/internal/db"
+	"messenger/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	maxSearchQueryLength = 256
+	maxSearchResults     = 50
+
+	// ts_headline wraps matches in these control characters; they are turned
+	// into <mark> tags after the rest of the snippet has been escaped
+	highlightStart = "\x01"
+	highlightStop  = "\x02"
+)
+
+// searchDocument is the indexed expression; it must match
+// idx_messages_content_search exactly for the index to be used
+var searchDocument = fmt.Sprintf("to_tsvector('%s', messages.content)", db.SearchConfig)
+
+// MessageSearchResult - найденное сообщение с подсвеченным фрагментом
+type MessageSearchResult struct {
+	Message models.Message `json:"message"`
+	// Snippet - HTML-экранированный фрагмент, совпадения обернуты в <mark>
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+// SearchMessages ищет сообщения по тексту во всех чатах и личных переписках, доступных пользователю
+func (h *MessageHandler) SearchMessages(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+		return
+	}
+	if len(text) > maxSearchQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is too long"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > maxSearchResults {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	tsQuery := fmt.Sprintf("websearch_to_tsquery('%s', ?)", db.SearchConfig)
+	query := h.db.DB.Table("messages").
+		Where("messages.deleted_at IS NULL").
+		Where(searchDocument+" @@ "+tsQuery, text)
+
+	// Доступ: активное членство, публичные чаты (как в GetMessages) и собственные личные переписки
+	memberChats := h.db.DB.Model(&models.ChatMember{}).
+		Select("chat_id").
+		Where("user_id = ? AND is_active = ?", userUUID, true)
+	publicChats := h.db.DB.Model(&models.Chat{}).
+		Select("id").
+		Where("type = ? AND is_active = ?", models.ChatTypePublic, true)
+	query = query.Where("(messages.chat_id IN (?) OR messages.chat_id IN (?) OR messages.receiver_id = ? OR (messages.sender_id = ? AND messages.receiver_id IS NOT NULL))",
+		memberChats, publicChats, userUUID, userUUID)
+
+	// Фильтры
+	if value := c.Query("chat_id"); value != "" {
+		chatID, err := uuid.Parse(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+			return
+		}
+		query = query.Where("messages.chat_id = ?", chatID)
+	}
+	if value := c.Query("receiver_id"); value != "" {
+		peerID, err := uuid.Parse(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid receiver ID"})
+			return
+		}
+		query = query.Where("((messages.sender_id = ? AND messages.receiver_id = ?) OR (messages.sender_id = ? AND messages.receiver_id = ?))",
+			userUUID, peerID, peerID, userUUID)
+	}
+	if value := c.Query("sender_id"); value != "" {
+		senderID, err := uuid.Parse(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sender ID"})
+			return
+		}
+		query = query.Where("messages.sender_id = ?", senderID)
+	}
+	if value := c.Query("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, expected RFC3339"})
+			return
+		}
+		query = query.Where("messages.created_at >= ?", from)
+	}
+	if value := c.Query("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, expected RFC3339"})
+			return
+		}
+		query = query.Where("messages.created_at <= ?", to)
+	}
+	if value := c.Query("type"); value != "" {
+		query = query.Where("messages.type = ?", models.MessageType(value))
+	}
+	if value := c.Query("has_attachments"); value != "" {
+		hasAttachments, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid has_attachments value"})
+			return
+		}
+		attachments := "EXISTS (SELECT 1 FROM files WHERE files.message_id = messages.id)"
+		if !hasAttachments {
+			attachments = "NOT " + attachments
+		}
+		query = query.Where(attachments)
+	}
+
+	// Сначала ранжируем и получаем фрагменты, затем загружаем сами сообщения
+	var hits []struct {
+		ID      uuid.UUID
+		Rank    float64
+		Snippet string
+	}
+	headlineOptions := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=35, MinWords=15, MaxFragments=2", highlightStart, highlightStop)
+	err = query.
+		Select("messages.id, ts_rank("+searchDocument+", "+tsQuery+") AS rank, ts_headline('"+db.SearchConfig+"', messages.content, "+tsQuery+", ?) AS snippet",
+			text, text, headlineOptions).
+		Order("rank DESC, messages.created_at DESC").
+		Limit(limit + 1).
+		Offset(offset).
+		Scan(&hits).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages"})
+		return
+	}
+
+	hasMore := len(hits) > limit
+	if hasMore {
+		hits = hits[:limit]
+	}
+
+	ids := make([]uuid.UUID, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+
+	var messages []models.Message
+	if len(ids) > 0 {
+		err = h.db.DB.Preload("Sender").
+			Preload("Receiver").
+			Preload("Chat").
+			Preload("Files").
+			Where("id IN ?", ids).
+			Find(&messages).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+	}
+
+	byID := make(map[uuid.UUID]models.Message, len(messages))
+	for _, message := range messages {
+		byID[message.ID] = message
+	}
+
+	results := make([]MessageSearchResult, 0, len(hits))
+	for _, hit := range hits {
+		message, ok := byID[hit.ID]
+		if !ok {
+			continue
+		}
+		results = append(results, MessageSearchResult{
+			Message: message,
+			Snippet: highlightSnippet(hit.Snippet),
+			Rank:    hit.Rank,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results":  results,
+		"has_more": hasMore,
+	})
+}
+
+// highlightSnippet escapes the snippet and turns the ts_headline markers
+// into <mark> tags
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
@@ -1,19 +1,399 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"messenger/internal/config"
+	"messenger/internal/contact"
+	"messenger/internal/db"
+	"messenger/internal/media"
+	"messenger/internal/quota"
+	"messenger/internal/receipt"
+	"messenger/internal/storage"
+	"messenger/internal/upload"
+	"messenger/internal/websocket"
+	"messenger/pkg/models"
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
+// multipartOverhead is the room left for form fields and boundaries on top
+// of the file itself
+const multipartOverhead = 1 << 20
+
 type UploadHandler struct {
-	// TODO: Add file service dependency
+	db        *db.Database
+	storage   storage.Storage
+	sessions  *upload.Manager
+	media     *media.Processor
+	quotas    *quota.Service
+	contacts  *contact.Service
+	receipts  *receipt.Service
+	publisher websocket.Publisher
+	config    *config.FileConfig
+}
+
+// uploadTarget - куда прикрепить файл: к существующему сообщению или к новому
+// сообщению в чате / личной переписке
+type uploadTarget struct {
+	MessageID  *uuid.UUID `json:"message_id"`
+	ChatID     *uuid.UUID `json:"chat_id"`
+	ReceiverID *uuid.UUID `json:"receiver_id"`
+	Content    string     `json:"content"`
+}
+
+// uploadError - ошибка загрузки с HTTP статусом для ответа клиенту
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
 }
 
-func NewUploadHandler() *UploadHandler {
-	return &UploadHandler{}
+func NewUploadHandler(database *db.Database, fileStorage storage.Storage, sessions *upload.Manager, processor *media.Processor, quotas *quota.Service, contacts *contact.Service, receipts *receipt.Service, publisher websocket.Publisher, fileConfig *config.FileConfig) *UploadHandler {
+	return &UploadHandler{
+		db:        database,
+		storage:   fileStorage,
+		sessions:  sessions,
+		media:     processor,
+		quotas:    quotas,
+		contacts:  contacts,
+		receipts:  receipts,
+		publisher: publisher,
+		config:    fileConfig,
+	}
 }
 
+// UploadFile принимает файл (multipart, поле file) и прикрепляет его к сообщению.
+// С message_id файл добавляется к существующему сообщению отправителя, с chat_id
+// или receiver_id создается новое сообщение; необязательное поле content - подпись.
 func (h *UploadHandler) UploadFile(c *gin.Context) {
-	// TODO: Implement file upload
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded"})
-}
\ No newline at end of file
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.config.MaxSize+multipartOverhead)
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		}
+		return
+	}
+	if header.Size > h.config.MaxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File exceeds %d bytes", h.config.MaxSize)})
+		return
+	}
+
+	target, err := formUploadTarget(c)
+	if err != nil {
+		respondUploadError(c, err)
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	record, message, err := h.attachFile(c.Request.Context(), userUUID, target, file, header.Size, header.Filename)
+	if err != nil {
+		respondUploadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"file":    record,
+		"message": message,
+	})
+}
+
+// attachFile проверяет тип файла по содержимому, сохраняет его в хранилище и
+// прикрепляет к сообщению, после чего рассылает событие о сообщении
+func (h *UploadHandler) attachFile(ctx context.Context, userID uuid.UUID, target *uploadTarget, file io.ReadSeeker, size int64, fileName string) (*models.File, *models.Message, error) {
+	// Тип определяем по содержимому, заголовку клиента не доверяем
+	detected, err := mimetype.DetectReader(file)
+	if err != nil {
+		return nil, nil, &uploadError{http.StatusBadRequest, "Failed to read file"}
+	}
+	if !h.isAllowed(detected) {
+		return nil, nil, &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("File type %s is not allowed", detected.String())}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	contentHash, err := hashContent(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Определяем сообщение, к которому будет прикреплен файл
+	message, err := h.resolveMessage(userID, target, messageTypeFor(detected))
+	if err != nil {
+		return nil, nil, err
+	}
+	isNewMessage := message.ID == uuid.Nil
+
+	if err := h.quotas.Check(userID, message.ChatID, contentHash, size); err != nil {
+		return nil, nil, quotaError(err)
+	}
+
+	record := models.File{
+		FileName:         filepath.Base(fileName),
+		FileSize:         size,
+		MimeType:         strings.SplitN(detected.String(), ";", 2)[0],
+		ContentHash:      contentHash,
+		ProcessingStatus: models.FileProcessingPending,
+	}
+
+	// Одинаковое содержимое храним один раз вместе с готовыми миниатюрами
+	var existing models.File
+	err = h.db.DB.Where("content_hash = ?", contentHash).Order("created_at").First(&existing).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, nil, err
+	}
+	stored := err == gorm.ErrRecordNotFound
+	if stored {
+		record.FilePath = fmt.Sprintf("%s/%s%s", time.Now().UTC().Format("2006/01/02"), uuid.New(), detected.Extension())
+		if err := h.storage.Put(ctx, record.FilePath, file, size, record.MimeType); err != nil {
+			return nil, nil, fmt.Errorf("failed to store %s: %w", record.FilePath, err)
+		}
+	} else {
+		record.FilePath = existing.FilePath
+		if existing.ProcessingStatus != models.FileProcessingPending {
+			record.ProcessingStatus = existing.ProcessingStatus
+			record.Width, record.Height = existing.Width, existing.Height
+			record.Duration = existing.Duration
+			record.BlurHash = existing.BlurHash
+			record.Thumbnails = existing.Thumbnails
+		}
+	}
+
+	err = h.db.DB.Transaction(func(tx *gorm.DB) error {
+		if isNewMessage {
+			if err := tx.Create(message).Error; err != nil {
+				return err
+			}
+		}
+		record.MessageID = message.ID
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		// Не оставляем в хранилище файл без записи в базе
+		if stored {
+			if err := h.storage.Delete(ctx, record.FilePath); err != nil {
+				log.Printf("Failed to remove orphaned upload %s: %v", record.FilePath, err)
+			}
+		}
+		return nil, nil, fmt.Errorf("failed to save file record: %w", err)
+	}
+
+	// Миниатюры и метаданные готовятся в фоне, затем приходит message_updated
+	if record.ProcessingStatus == models.FileProcessingPending {
+		h.media.Enqueue(record.ID)
+	}
+
+	// Загружаем сообщение с полной информацией
+	err = h.db.DB.Preload("Sender").
+		Preload("Receiver").
+		Preload("Chat").
+		Preload("ReplyTo").
+		Preload("Files").
+		Preload("Reactions.User").
+		First(message, message.ID).Error
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch message: %w", err)
+	}
+
+	eventType := websocket.MessageTypeMessageUpdated
+	if isNewMessage {
+		eventType = websocket.MessageTypeNewMessage
+	}
+	publishMessageEvent(h.publisher, eventType, userID, message, *message)
+	if isNewMessage {
+		h.receipts.PublishUnreadCounts(message)
+	}
+
+	return &record, message, nil
+}
+
+// resolveMessage возвращает существующее сообщение отправителя (по message_id) или
+// новое, еще не сохраненное сообщение для chat_id/receiver_id
+func (h *UploadHandler) resolveMessage(userID uuid.UUID, target *uploadTarget, messageType models.MessageType) (*models.Message, error) {
+	if target.MessageID != nil {
+		var message models.Message
+		err := h.db.DB.Where("id = ?", *target.MessageID).First(&message).Error
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, &uploadError{http.StatusNotFound, "Message not found"}
+			}
+			return nil, err
+		}
+
+		// Прикреплять файлы можно только к своим сообщениям
+		if message.SenderID != userID {
+			return nil, &uploadError{http.StatusForbidden, "You can only attach files to your own messages"}
+		}
+		return &message, nil
+	}
+
+	message := &models.Message{
+		SenderID: userID,
+		Content:  target.Content,
+		Type:     messageType,
+		Status:   models.MessageStatusSent,
+	}
+
+	if target.ChatID != nil {
+		var chat models.Chat
+		err := h.db.DB.Where("id = ? AND is_active = ?", *target.ChatID, true).First(&chat).Error
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, &uploadError{http.StatusNotFound, "Chat not found"}
+			}
+			return nil, err
+		}
+
+		// Для приватных и групповых чатов проверяем членство, в публичные может писать любой
+		if chat.Type != models.ChatTypePublic {
+			var member models.ChatMember
+			err = h.db.DB.Where("chat_id = ? AND user_id = ? AND is_active = ?", *target.ChatID, userID, true).
+				First(&member).Error
+			if err != nil {
+				return nil, &uploadError{http.StatusForbidden, "Access denied to this chat"}
+			}
+		}
+
+		message.ChatID = target.ChatID
+		return message, nil
+	}
+
+	if target.ReceiverID != nil {
+		blocked, err := h.contacts.IsBlocked(userID, *target.ReceiverID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, &uploadError{http.StatusForbidden, "You cannot message this user"}
+		}
+
+		message.ReceiverID = target.ReceiverID
+		return message, nil
+	}
+
+	return nil, &uploadError{http.StatusBadRequest, "One of message_id, chat_id or receiver_id must be provided"}
+}
+
+// hashContent returns the hex SHA-256 of file and rewinds it
+func hashContent(file io.ReadSeeker) (string, error) {
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return "", &uploadError{http.StatusBadRequest, "Failed to read file"}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// quotaError переводит превышение квоты в ответ 413 с понятным сообщением
+func quotaError(err error) error {
+	var exceeded *quota.Error
+	if errors.As(err, &exceeded) {
+		scope := "Storage"
+		if exceeded.Scope == "chat" {
+			scope = "Chat storage"
+		}
+		return &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s quota exceeded: %d of %d bytes used, file needs %d",
+			scope, exceeded.Used, exceeded.Quota, exceeded.Size)}
+	}
+	return err
+}
+
+// formUploadTarget читает поля message_id, chat_id, receiver_id и content из формы
+func formUploadTarget(c *gin.Context) (*uploadTarget, error) {
+	target := &uploadTarget{Content: c.PostForm("content")}
+	fields := []struct {
+		name  string
+		value **uuid.UUID
+	}{
+		{"message_id", &target.MessageID},
+		{"chat_id", &target.ChatID},
+		{"receiver_id", &target.ReceiverID},
+	}
+	for _, field := range fields {
+		value := c.PostForm(field.name)
+		if value == "" {
+			continue
+		}
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, &uploadError{http.StatusBadRequest, "Invalid " + field.name}
+		}
+		*field.value = &id
+	}
+	return target, nil
+}
+
+// respondUploadError отвечает клиенту статусом из uploadError или 500
+func respondUploadError(c *gin.Context, err error) {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		c.JSON(uploadErr.status, gin.H{"error": uploadErr.message})
+		return
+	}
+	log.Printf("Upload failed: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+}
+
+// isAllowed сверяет определенный тип со списком разрешенных, учитывая синонимы
+func (h *UploadHandler) isAllowed(detected *mimetype.MIME) bool {
+	for _, allowed := range h.config.AllowedTypes {
+		if detected.Is(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageTypeFor выбирает тип сообщения по типу файла
+func messageTypeFor(detected *mimetype.MIME) models.MessageType {
+	switch {
+	case strings.HasPrefix(detected.String(), "image/"):
+		return models.MessageTypeImage
+	case strings.HasPrefix(detected.String(), "video/"):
+		return models.MessageTypeVideo
+	case strings.HasPrefix(detected.String(), "audio/"):
+		return models.MessageTypeAudio
+	default:
+		return models.MessageTypeFile
+	}
+}
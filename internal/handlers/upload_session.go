@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"messenger/internal/upload"
+	"messenger/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Заголовки протокола докачки
+const (
+	headerUploadOffset   = "Upload-Offset"
+	headerUploadLength   = "Upload-Length"
+	headerUploadChecksum = "Upload-Checksum"
+)
+
+// CreateUploadSessionRequest - запрос на создание сессии докачки
+type CreateUploadSessionRequest struct {
+	uploadTarget
+	FileName string `json:"file_name" binding:"required"`
+	FileSize int64  `json:"file_size" binding:"required"`
+	// Checksum - SHA-256 всего файла в hex, проверяется при завершении
+	Checksum string `json:"checksum"`
+}
+
+// CreateUploadSession создает сессию докачки. Дальше клиент отправляет части
+// через PATCH /uploads/:id и завершает загрузку через POST /uploads/:id/complete.
+func (h *UploadHandler) CreateUploadSession(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	var req CreateUploadSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Checksum) != 0 && len(req.Checksum) != 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "checksum must be a hex SHA-256 digest"})
+		return
+	}
+
+	// Проверяем права заранее, чтобы не принимать сотни мегабайт впустую.
+	// При завершении права проверяются еще раз.
+	message, err := h.resolveMessage(userUUID, &req.uploadTarget, models.MessageTypeFile)
+	if err != nil {
+		respondUploadError(c, err)
+		return
+	}
+	if err := h.quotas.Check(userUUID, message.ChatID, strings.ToLower(req.Checksum), req.FileSize); err != nil {
+		respondUploadError(c, quotaError(err))
+		return
+	}
+
+	session := models.UploadSession{
+		UserID:     userUUID,
+		FileName:   filepath.Base(req.FileName),
+		FileSize:   req.FileSize,
+		Checksum:   req.Checksum,
+		MessageID:  req.MessageID,
+		ChatID:     req.ChatID,
+		ReceiverID: req.ReceiverID,
+		Content:    req.Content,
+	}
+	if err := h.sessions.Create(&session); err != nil {
+		h.respondSessionError(c, err)
+		return
+	}
+
+	c.Header(headerUploadOffset, "0")
+	c.Header(headerUploadLength, strconv.FormatInt(session.FileSize, 10))
+	c.JSON(http.StatusCreated, gin.H{"session": session})
+}
+
+// GetUploadSession возвращает состояние сессии; offset - сколько байт уже принято
+func (h *UploadHandler) GetUploadSession(c *gin.Context) {
+	session, ok := h.loadSession(c)
+	if !ok {
+		return
+	}
+
+	c.Header(headerUploadOffset, strconv.FormatInt(session.BytesReceived, 10))
+	c.Header(headerUploadLength, strconv.FormatInt(session.FileSize, 10))
+	c.JSON(http.StatusOK, gin.H{"session": session})
+}
+
+// UploadChunk дописывает часть файла. Заголовок Upload-Offset должен совпадать с
+// текущим offset сессии; необязательный Upload-Checksum - SHA-256 части в hex.
+func (h *UploadHandler) UploadChunk(c *gin.Context) {
+	session, ok := h.loadSession(c)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader(headerUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset header is required"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, upload.MaxChunkSize+1)
+	err = h.sessions.Append(session, offset, c.Request.Body, c.GetHeader(headerUploadChecksum))
+	c.Header(headerUploadOffset, strconv.FormatInt(session.BytesReceived, 10))
+	if err != nil {
+		h.respondSessionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session": session})
+}
+
+// CompleteUploadSession проверяет полноту и контрольную сумму файла и прикрепляет его к сообщению
+func (h *UploadHandler) CompleteUploadSession(c *gin.Context) {
+	session, ok := h.loadSession(c)
+	if !ok {
+		return
+	}
+
+	target := &uploadTarget{
+		MessageID:  session.MessageID,
+		ChatID:     session.ChatID,
+		ReceiverID: session.ReceiverID,
+		Content:    session.Content,
+	}
+
+	var record *models.File
+	var message *models.Message
+	err := h.sessions.Finish(session, func(file *os.File) error {
+		var err error
+		record, message, err = h.attachFile(c.Request.Context(), session.UserID, target, file, session.FileSize, session.FileName)
+		return err
+	})
+	if err != nil {
+		h.respondSessionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"file":    record,
+		"message": message,
+	})
+}
+
+// AbortUploadSession отменяет загрузку и удаляет принятые части
+func (h *UploadHandler) AbortUploadSession(c *gin.Context) {
+	session, ok := h.loadSession(c)
+	if !ok {
+		return
+	}
+
+	if err := h.sessions.Abort(session); err != nil {
+		h.respondSessionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Upload cancelled"})
+}
+
+// loadSession находит сессию текущего пользователя по :id и отвечает клиенту при ошибке
+func (h *UploadHandler) loadSession(c *gin.Context) (*models.UploadSession, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return nil, false
+	}
+
+	sessionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload session ID"})
+		return nil, false
+	}
+
+	session, err := h.sessions.Get(userUUID, sessionID)
+	if err != nil {
+		h.respondSessionError(c, err)
+		return nil, false
+	}
+	return session, true
+}
+
+// respondSessionError переводит ошибки сессии докачки в HTTP ответы
+func (h *UploadHandler) respondSessionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, upload.ErrSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload session not found"})
+	case errors.Is(err, upload.ErrSessionExpired), errors.Is(err, upload.ErrSessionCompleted):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, upload.ErrOffsetMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, upload.ErrChunkTooLarge), errors.Is(err, upload.ErrTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, upload.ErrChecksumMismatch):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, upload.ErrIncomplete):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		respondUploadError(c, err)
+	}
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"messenger/internal/config"
+	"messenger/internal/storage"
+	"messenger/pkg/models"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	pngHeader   = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+	pdfContent  = []byte("%PDF-1.4\n1 0 obj\n<<>>\nendobj\n")
+	htmlContent = []byte("<!DOCTYPE html><html><body><script>alert(1)</script></body></html>")
+	exeContent  = append([]byte("MZ\x90\x00\x03\x00\x00\x00"), make([]byte, 120)...)
+)
+
+// rejectingStorage fails the test when anything is written
+type rejectingStorage struct {
+	storage.Storage
+	t *testing.T
+}
+
+func (s rejectingStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	s.t.Errorf("rejected file was stored as %s", key)
+	return nil
+}
+
+func newTestUploadHandler(t *testing.T, maxSize int64) *UploadHandler {
+	return &UploadHandler{
+		storage: rejectingStorage{t: t},
+		config: &config.FileConfig{
+			MaxSize:      maxSize,
+			AllowedTypes: []string{"image/png", "image/jpeg", "application/pdf", "text/plain"},
+		},
+	}
+}
+
+func TestAttachFileRejectsDisallowedContent(t *testing.T) {
+	h := newTestUploadHandler(t, 1<<20)
+
+	tests := []struct {
+		name     string
+		fileName string
+		content  []byte
+	}{
+		// The name and extension do not matter, only the content does
+		{"html named as png", "photo.png", htmlContent},
+		{"executable named as pdf", "report.pdf", exeContent},
+		{"executable", "setup.exe", exeContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &uploadTarget{ReceiverID: &uuid.UUID{}}
+			_, _, err := h.attachFile(context.Background(), uuid.New(), target, bytes.NewReader(tt.content), int64(len(tt.content)), tt.fileName)
+
+			var uploadErr *uploadError
+			if !errors.As(err, &uploadErr) || uploadErr.status != http.StatusUnsupportedMediaType {
+				t.Fatalf("got %v, want 415", err)
+			}
+		})
+	}
+}
+
+func TestUploadTypeDetection(t *testing.T) {
+	h := newTestUploadHandler(t, 1<<20)
+
+	tests := []struct {
+		name        string
+		content     []byte
+		allowed     bool
+		mime        string
+		messageType models.MessageType
+	}{
+		{"png", pngHeader, true, "image/png", models.MessageTypeImage},
+		{"pdf", pdfContent, true, "application/pdf", models.MessageTypeFile},
+		{"plain text", []byte("just some notes\n"), true, "text/plain", models.MessageTypeFile},
+		{"html", htmlContent, false, "text/html", models.MessageTypeFile},
+		{"executable", exeContent, false, "application/vnd.microsoft.portable-executable", models.MessageTypeFile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detected := mimetype.Detect(tt.content)
+			if !detected.Is(tt.mime) {
+				t.Fatalf("detected %s, want %s", detected, tt.mime)
+			}
+			if got := h.isAllowed(detected); got != tt.allowed {
+				t.Errorf("allowed = %v, want %v", got, tt.allowed)
+			}
+			if got := messageTypeFor(detected); got != tt.messageType {
+				t.Errorf("message type = %s, want %s", got, tt.messageType)
+			}
+		})
+	}
+}
+
+func TestUploadFileRejectsOversizeBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newTestUploadHandler(t, 1024)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "big.txt")
+	part.Write([]byte(strings.Repeat("a", multipartOverhead+2048)))
+	form.WriteField("receiver_id", uuid.New().String())
+	form.Close()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/files/upload", &body)
+	c.Request.Header.Set("Content-Type", form.FormDataContentType())
+	c.Set("user_id", uuid.New())
+
+	h.UploadFile(c)
+
+	// The body is cut off while parsing, before the form reports the size
+	if recorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(recorder.Body.String(), "File is too large") {
+		t.Fatalf("got %d %s, want 413 File is too large", recorder.Code, recorder.Body)
+	}
+}
@@ -1,23 +1,33 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 	"messenger/pkg/models"
+	"messenger/internal/auth"
+	"messenger/internal/contact"
 	"messenger/internal/db"
+	"messenger/internal/quota"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type UserHandler struct {
-	db *db.Database
+	db          *db.Database
+	quotas      *quota.Service
+	contacts    *contact.Service
+	authService *auth.Service
 }
 
-func NewUserHandler(database *db.Database) *UserHandler {
+func NewUserHandler(database *db.Database, quotas *quota.Service, contacts *contact.Service, authService *auth.Service) *UserHandler {
 	return &UserHandler{
-		db: database,
+		db:          database,
+		quotas:      quotas,
+		contacts:    contacts,
+		authService: authService,
 	}
 }
 
@@ -88,6 +98,16 @@ func (h *UserHandler) GetUsers(c *gin.Context) {
 	// Исключаем текущего пользователя из результатов
 	query = query.Where("id != ?", userUUID)
 
+	// Исключаем пользователей, заблокированных текущим, и тех, кто заблокировал его
+	blockedIDs, err := h.contacts.BlockedIDs(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	if len(blockedIDs) > 0 {
+		query = query.Where("id NOT IN ?", blockedIDs)
+	}
+
 	// Поиск по имени пользователя, email или полному имени
 	if search != "" {
 		query = query.Where("username ILIKE ? OR email ILIKE ? OR first_name ILIKE ? OR last_name ILIKE ?",
@@ -153,6 +173,17 @@ func (h *UserHandler) GetUser(c *gin.Context) {
 		return
 	}
 
+	// Заблокировавший пользователь выглядит для заблокированного всегда офлайн
+	blocked, err := h.contacts.IsBlockedBy(userUUID, targetUserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	if blocked {
+		user.Status = models.StatusOffline
+		user.LastSeen = nil
+	}
+
 	// Для других пользователей возвращаем публичную информацию
 	publicUser := struct {
 		ID        uuid.UUID           `json:"id"`
@@ -240,8 +271,11 @@ func (h *UserHandler) UpdateMe(c *gin.Context) {
 	if request.Avatar != "" {
 		updates["avatar"] = request.Avatar
 	}
-	if request.Email != "" {
+	emailChanged := request.Email != "" && request.Email != user.Email
+	if emailChanged {
+		// Новый адрес нужно подтвердить заново
 		updates["email"] = request.Email
+		updates["email_verified_at"] = nil
 	}
 
 	err = h.db.DB.Model(&user).Updates(updates).Error
@@ -257,6 +291,12 @@ func (h *UserHandler) UpdateMe(c *gin.Context) {
 		return
 	}
 
+	if emailChanged {
+		if err := h.authService.SendVerification(user.ID); err != nil {
+			log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
+		}
+	}
+
 	// Скрываем пароль
 	user.Password = ""
 
@@ -333,4 +373,28 @@ func (h *UserHandler) UpdateStatus(c *gin.Context) {
 	user.Password = ""
 
 	c.JSON(http.StatusOK, gin.H{"user": user})
-}
\ No newline at end of file
+}
+
+// GetStorageUsage возвращает занятое место и квоту текущего пользователя с
+// разбивкой по типам файлов и чатам
+func (h *UserHandler) GetStorageUsage(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	userUUID, ok := userID.(uuid.UUID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID type"})
+		return
+	}
+
+	report, err := h.quotas.Report(userUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate storage usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"storage": report})
+}
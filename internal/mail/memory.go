@@ -0,0 +1,56 @@
+package mail
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// LogMailer writes every message to the log instead of sending it and keeps
+// the most recent ones in memory. It is meant for local development, where
+// the verification and reset links can be copied from the server output, and
+// for tests.
+type LogMailer struct {
+	mutex    sync.Mutex
+	messages []Message
+	limit    int
+}
+
+// NewLogMailer keeps up to limit messages; older ones are dropped
+func NewLogMailer(limit int) *LogMailer {
+	return &LogMailer{limit: limit}
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	log.Printf("Mail to %s: %s\n%s", message.To, message.Subject, message.Body)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.messages = append(m.messages, message)
+	if m.limit > 0 && len(m.messages) > m.limit {
+		m.messages = m.messages[len(m.messages)-m.limit:]
+	}
+	return nil
+}
+
+// Messages returns the kept messages, oldest first
+func (m *LogMailer) Messages() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
+
+// Last returns the newest message sent to an address
+func (m *LogMailer) Last(to string) (Message, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			return m.messages[i], true
+		}
+	}
+	return Message{}, false
+}
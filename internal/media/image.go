@@ -0,0 +1,133 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strconv"
+	"messenger/pkg/models"
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+
+	// Decoders for image.Decode
+	_ "image/gif"
+	_ "image/png"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// maxPixels guards against decompression bombs
+	maxPixels = 50_000_000
+
+	thumbnailQuality = 80
+
+	// Blurhash components; 4x3 suits both landscape and portrait previews
+	blurHashX = 4
+	blurHashY = 3
+)
+
+func (p *Processor) processImage(ctx context.Context, file *models.File) error {
+	content, err := p.storage.Open(ctx, file.FilePath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	img, err := decodeImage(content)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	file.Width, file.Height = bounds.Dx(), bounds.Dy()
+	return p.generateThumbnails(ctx, file, img)
+}
+
+// generateThumbnails stores a JPEG for every configured size smaller than
+// the image and computes the blurhash from the smallest of them
+func (p *Processor) generateThumbnails(ctx context.Context, file *models.File, img image.Image) error {
+	source := img
+	for _, size := range p.sizes {
+		bounds := source.Bounds()
+		if bounds.Dx() <= size && bounds.Dy() <= size {
+			continue
+		}
+
+		thumbnail := resize(source, size)
+		name := strconv.Itoa(size)
+		if err := p.putJPEG(ctx, file, name, thumbnail); err != nil {
+			return err
+		}
+		source = thumbnail
+	}
+
+	hash, err := blurhash.Encode(blurHashX, blurHashY, resize(source, 32))
+	if err != nil {
+		return fmt.Errorf("failed to compute blurhash: %w", err)
+	}
+	file.BlurHash = hash
+	return nil
+}
+
+// putJPEG uploads img as a thumbnail of file under name
+func (p *Processor) putJPEG(ctx context.Context, file *models.File, name string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	key := thumbnailKey(file.ID, name)
+	if err := p.storage.Put(ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), "image/jpeg"); err != nil {
+		return fmt.Errorf("failed to store thumbnail %s: %w", key, err)
+	}
+
+	bounds := img.Bounds()
+	file.Thumbnails = append(file.Thumbnails, models.Thumbnail{
+		Name:     name,
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		MimeType: "image/jpeg",
+		Path:     key,
+	})
+	return nil
+}
+
+func decodeImage(r io.ReadSeeker) (image.Image, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("image is too large: %dx%d", config.Width, config.Height)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// resize scales img so its longest side is size, flattening transparency
+// onto white since the result is stored as JPEG
+func resize(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := size, size
+	if bounds.Dx() >= bounds.Dy() {
+		height = max(1, bounds.Dy()*size/bounds.Dx())
+	} else {
+		width = max(1, bounds.Dx()*size/bounds.Dy())
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
@@ -0,0 +1,246 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"messenger/internal/config"
+	"messenger/internal/storage"
+	"messenger/internal/websocket"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	queueSize = 1024
+
+	// processTimeout bounds the work on a single file, ffmpeg included
+	processTimeout = 5 * time.Minute
+
+	// sweepInterval is how often pending files that never made it into the
+	// queue are looked up again
+	sweepInterval = time.Minute
+)
+
+// Processor generates thumbnails, blurhash placeholders and media metadata
+// for uploaded files in the background. When a file is done the message it
+// belongs to is re-published as message_updated.
+type Processor struct {
+	db        *gorm.DB
+	storage   storage.Storage
+	publisher websocket.Publisher
+	sizes     []int
+	workers   int
+
+	// Empty when the binaries are not installed; videos are then skipped
+	ffmpeg  string
+	ffprobe string
+
+	queue chan uuid.UUID
+	// queued holds the files in the queue or being processed, so a sweep
+	// never hands the same file to two workers
+	queued map[uuid.UUID]bool
+	mutex  sync.Mutex
+}
+
+func NewProcessor(db *gorm.DB, fileStorage storage.Storage, publisher websocket.Publisher, cfg *config.FileConfig) *Processor {
+	// Largest first, so every thumbnail is scaled down from the previous one
+	sizes := append([]int(nil), cfg.ThumbnailSizes...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+
+	workers := cfg.MediaWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	return &Processor{
+		db:        db,
+		storage:   fileStorage,
+		publisher: publisher,
+		sizes:     sizes,
+		workers:   workers,
+		ffmpeg:    lookPath(cfg.FFmpegPath),
+		ffprobe:   lookPath(cfg.FFprobePath),
+		queue:     make(chan uuid.UUID, queueSize),
+		queued:    make(map[uuid.UUID]bool),
+	}
+}
+
+// Enqueue schedules a file for processing. It never blocks; when the queue
+// is full the file stays pending and is picked up by the next sweep.
+func (p *Processor) Enqueue(fileID uuid.UUID) {
+	if !p.claim(fileID) {
+		return
+	}
+
+	select {
+	case p.queue <- fileID:
+	default:
+		p.release(fileID)
+		log.Printf("Media queue is full, file %s stays pending until the next sweep", fileID)
+	}
+}
+
+// Run starts the workers and queues pending files: the ones left by a
+// previous run right away, and every sweepInterval the ones Enqueue could
+// not fit into a full queue
+func (p *Processor) Run() {
+	for i := 0; i < p.workers; i++ {
+		go p.work()
+	}
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		p.queuePending()
+		<-ticker.C
+	}
+}
+
+// queuePending queues every pending file that is not queued yet, waiting
+// for room in the queue
+func (p *Processor) queuePending() {
+	var pending []models.File
+	err := p.db.Select("id").
+		Where("processing_status = ?", models.FileProcessingPending).
+		FindInBatches(&pending, 500, func(tx *gorm.DB, batch int) error {
+			for _, file := range pending {
+				if p.claim(file.ID) {
+					p.queue <- file.ID
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		log.Printf("Failed to queue pending media files: %v", err)
+	}
+}
+
+// claim marks a file as queued and reports whether it was not already
+func (p *Processor) claim(fileID uuid.UUID) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.queued[fileID] {
+		return false
+	}
+	p.queued[fileID] = true
+	return true
+}
+
+func (p *Processor) release(fileID uuid.UUID) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.queued, fileID)
+}
+
+func (p *Processor) work() {
+	for fileID := range p.queue {
+		p.process(fileID)
+		p.release(fileID)
+	}
+}
+
+func (p *Processor) process(fileID uuid.UUID) {
+	var file models.File
+	if err := p.db.Where("id = ?", fileID).First(&file).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Printf("Failed to load file %s for processing: %v", fileID, err)
+		}
+		return
+	}
+	if file.ProcessingStatus != models.FileProcessingPending {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), processTimeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case strings.HasPrefix(file.MimeType, "image/"):
+		err = p.processImage(ctx, &file)
+	case strings.HasPrefix(file.MimeType, "video/") && p.ffmpeg != "" && p.ffprobe != "":
+		err = p.processVideo(ctx, &file)
+	case strings.HasPrefix(file.MimeType, "audio/") && p.ffprobe != "":
+		err = p.processAudio(ctx, &file)
+	default:
+		file.ProcessingStatus = models.FileProcessingSkipped
+	}
+
+	if err != nil {
+		log.Printf("Failed to process file %s: %v", file.ID, err)
+		p.removeThumbnails(&file)
+		file = models.File{ID: file.ID, MessageID: file.MessageID, ProcessingStatus: models.FileProcessingFailed}
+	} else if file.ProcessingStatus == models.FileProcessingPending {
+		file.ProcessingStatus = models.FileProcessingReady
+	}
+
+	err = p.db.Model(&models.File{ID: file.ID}).
+		Select("processing_status", "width", "height", "duration", "blur_hash", "thumbnails").
+		Updates(&file).Error
+	if err != nil {
+		log.Printf("Failed to save media metadata for %s: %v", file.ID, err)
+		p.removeThumbnails(&file)
+		return
+	}
+
+	if file.ProcessingStatus != models.FileProcessingSkipped {
+		p.publish(file.MessageID)
+	}
+}
+
+// publish re-sends the message so clients pick up the new metadata
+func (p *Processor) publish(messageID uuid.UUID) {
+	var message models.Message
+	err := p.db.Preload("Sender").
+		Preload("Receiver").
+		Preload("Chat").
+		Preload("ReplyTo").
+		Preload("Files").
+		Preload("Reactions.User").
+		First(&message, messageID).Error
+	if err != nil {
+		// The message may have been deleted in the meantime
+		return
+	}
+
+	if message.ChatID != nil {
+		if err := p.publisher.PublishToChat(*message.ChatID, websocket.MessageTypeMessageUpdated, message.SenderID, message); err != nil {
+			log.Printf("Failed to publish processed media for message %s: %v", message.ID, err)
+		}
+		return
+	}
+	if message.ReceiverID != nil {
+		p.publisher.PublishToUsers([]uuid.UUID{message.SenderID, *message.ReceiverID}, websocket.MessageTypeMessageUpdated, message.SenderID, message)
+	}
+}
+
+func (p *Processor) removeThumbnails(file *models.File) {
+	for _, thumbnail := range file.Thumbnails {
+		if err := p.storage.Delete(context.Background(), thumbnail.Path); err != nil {
+			log.Printf("Failed to remove thumbnail %s: %v", thumbnail.Path, err)
+		}
+	}
+}
+
+func thumbnailKey(fileID uuid.UUID, name string) string {
+	return fmt.Sprintf("thumbnails/%s/%s.jpg", fileID, name)
+}
+
+func lookPath(name string) string {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		log.Printf("%s not found, video and audio metadata will not be extracted", name)
+		return ""
+	}
+	return path
+}
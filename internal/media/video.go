@@ -0,0 +1,150 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"messenger/pkg/models"
+)
+
+// probeResult is the subset of `ffprobe -of json` output we use
+type probeResult struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+func (p *Processor) processVideo(ctx context.Context, file *models.File) error {
+	path, cleanup, err := p.localCopy(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	probe, err := p.probe(ctx, path)
+	if err != nil {
+		return err
+	}
+	file.Duration = probe.duration()
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			file.Width, file.Height = stream.Width, stream.Height
+			break
+		}
+	}
+
+	// Take the poster a second in, unless the clip is shorter than that
+	offset := 1.0
+	if file.Duration > 0 && file.Duration < 2 {
+		offset = file.Duration / 2
+	}
+	poster, err := p.posterFrame(ctx, path, offset)
+	if err != nil {
+		return err
+	}
+
+	if err := p.putJPEG(ctx, file, "poster", poster); err != nil {
+		return err
+	}
+	return p.generateThumbnails(ctx, file, poster)
+}
+
+func (p *Processor) processAudio(ctx context.Context, file *models.File) error {
+	path, cleanup, err := p.localCopy(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	probe, err := p.probe(ctx, path)
+	if err != nil {
+		return err
+	}
+	file.Duration = probe.duration()
+	return nil
+}
+
+func (p *Processor) probe(ctx context.Context, path string) (*probeResult, error) {
+	output, err := exec.CommandContext(ctx, p.ffprobe,
+		"-v", "error",
+		"-show_entries", "stream=codec_type,width,height:format=duration",
+		"-of", "json",
+		path,
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var result probeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return &result, nil
+}
+
+func (r *probeResult) duration() float64 {
+	duration, _ := strconv.ParseFloat(r.Format.Duration, 64)
+	return duration
+}
+
+// posterFrame extracts a single frame at offset seconds
+func (p *Processor) posterFrame(ctx context.Context, path string, offset float64) (image.Image, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.ffmpeg,
+		"-v", "error",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-i", path,
+		"-frames:v", "1",
+		"-f", "image2pipe",
+		"-vcodec", "png",
+		"-",
+	)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg produced no frame")
+	}
+
+	return decodeImage(bytes.NewReader(stdout.Bytes()))
+}
+
+// localCopy downloads the file to a temporary path for ffmpeg, which needs
+// to seek freely and cannot read from object storage directly
+func (p *Processor) localCopy(ctx context.Context, file *models.File) (string, func(), error) {
+	content, err := p.storage.Open(ctx, file.FilePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer content.Close()
+
+	tmp, err := os.CreateTemp("", "media-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup := func() {
+		os.Remove(tmp.Name())
+	}
+
+	_, err = io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to copy file for processing: %w", err)
+	}
+	return tmp.Name(), cleanup, nil
+}
@@ -25,6 +25,7 @@ func AuthMiddleware(authService *auth.Service) gin.HandlerFunc {
 
 		// Store user info in context
 		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
 		c.Set("username", claims.Username)
 		c.Set("email", claims.Email)
 		c.Set("token", token)
@@ -33,6 +34,26 @@ func AuthMiddleware(authService *auth.Service) gin.HandlerFunc {
 	}
 }
 
+// OptionalAuthMiddleware stores the user of a valid bearer token in the
+// context but lets requests without one through, for endpoints that accept
+// other credentials as well
+func OptionalAuthMiddleware(authService *auth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := extractTokenFromHeader(c.GetHeader("Authorization"))
+		if token != "" {
+			if claims, err := authService.ValidateToken(token); err == nil {
+				c.Set("user_id", claims.UserID)
+				c.Set("session_id", claims.SessionID)
+				c.Set("username", claims.Username)
+				c.Set("email", claims.Email)
+				c.Set("token", token)
+			}
+		}
+
+		c.Next()
+	}
+}
+
 func extractTokenFromHeader(header string) string {
 	if header == "" {
 		return ""
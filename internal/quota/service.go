@@ -0,0 +1,252 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"messenger/internal/config"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// contentKey identifies a file's content for deduplication. Files uploaded
+// before hashing was introduced count individually.
+const contentKey = "COALESCE(NULLIF(files.content_hash, ''), files.id::text)"
+
+// Error reports which quota an upload would exceed
+type Error struct {
+	Scope string // "user" or "chat"
+	Used  int64
+	Quota int64
+	Size  int64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s storage quota exceeded: %d of %d bytes used, file needs %d", e.Scope, e.Used, e.Quota, e.Size)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Usage is the space taken within a quota; Quota is 0 when unlimited
+type Usage struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"`
+	Files int64 `json:"files"`
+}
+
+// ChatUsage is a user's share of one chat's storage, along with the chat total
+type ChatUsage struct {
+	ChatID uuid.UUID `json:"chat_id"`
+	Name   string    `json:"name"`
+	Used   int64     `json:"used"`
+	Chat   Usage     `json:"chat"`
+}
+
+// Report breaks a user's storage down by file type and by conversation
+type Report struct {
+	Usage
+	ByType map[string]int64 `json:"by_type"`
+	Chats  []ChatUsage      `json:"chats"`
+	Direct int64            `json:"direct"`
+}
+
+// Service accounts storage per uploader and per chat. Usage is the size of
+// the distinct contents a user sent (or a chat received) in messages that
+// still exist, so forwarding the same file again is free.
+type Service struct {
+	db        *gorm.DB
+	userQuota int64
+	chatQuota int64
+}
+
+func NewService(db *gorm.DB, cfg *config.FileConfig) *Service {
+	return &Service{
+		db:        db,
+		userQuota: cfg.UserQuota,
+		chatQuota: cfg.ChatQuota,
+	}
+}
+
+// Check verifies that userID may store size more bytes, in chatID when set.
+// Content the user (or chat) already holds, identified by contentHash, is
+// not charged again.
+func (s *Service) Check(userID uuid.UUID, chatID *uuid.UUID, contentHash string, size int64) error {
+	usage, err := s.UserUsage(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.check("user", usage, s.bySender(userID), contentHash, size); err != nil {
+		return err
+	}
+
+	if chatID == nil {
+		return nil
+	}
+	usage, err = s.ChatUsage(*chatID)
+	if err != nil {
+		return err
+	}
+	return s.check("chat", usage, s.inChat(*chatID), contentHash, size)
+}
+
+func (s *Service) check(scope string, usage *Usage, owned func(*gorm.DB) *gorm.DB, contentHash string, size int64) error {
+	if usage.Quota == 0 || usage.Used+size <= usage.Quota {
+		return nil
+	}
+
+	if contentHash != "" {
+		var count int64
+		err := s.files().Scopes(owned).Where("files.content_hash = ?", contentHash).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+	}
+
+	return &Error{Scope: scope, Used: usage.Used, Quota: usage.Quota, Size: size}
+}
+
+// UserUsage returns the storage used by files userID uploaded
+func (s *Service) UserUsage(userID uuid.UUID) (*Usage, error) {
+	var user models.User
+	if err := s.db.Select("id", "storage_quota").Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	usage, err := s.usage(s.bySender(userID))
+	if err != nil {
+		return nil, err
+	}
+	usage.Quota = s.userQuota
+	if user.StorageQuota != nil {
+		usage.Quota = *user.StorageQuota
+	}
+	return usage, nil
+}
+
+// ChatUsage returns the storage used by files sent to chatID
+func (s *Service) ChatUsage(chatID uuid.UUID) (*Usage, error) {
+	var chat models.Chat
+	if err := s.db.Select("id", "storage_quota").Where("id = ?", chatID).First(&chat).Error; err != nil {
+		return nil, err
+	}
+
+	usage, err := s.usage(s.inChat(chatID))
+	if err != nil {
+		return nil, err
+	}
+	usage.Quota = s.chatQuota
+	if chat.StorageQuota != nil {
+		usage.Quota = *chat.StorageQuota
+	}
+	return usage, nil
+}
+
+// Report returns userID's usage broken down by file type and conversation
+func (s *Service) Report(userID uuid.UUID) (*Report, error) {
+	usage, err := s.UserUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Usage: *usage, ByType: make(map[string]int64)}
+
+	// By type: each content once, like the total
+	var byType []struct {
+		Category string
+		Used     int64
+	}
+	distinct := s.files().Scopes(s.bySender(userID)).
+		Select("DISTINCT ON (" + contentKey + ") files.file_size, files.mime_type")
+	err = s.db.Table("(?) AS owned", distinct).
+		Select("CASE WHEN mime_type LIKE 'image/%' THEN 'image' " +
+			"WHEN mime_type LIKE 'video/%' THEN 'video' " +
+			"WHEN mime_type LIKE 'audio/%' THEN 'audio' " +
+			"ELSE 'other' END AS category, SUM(file_size) AS used").
+		Group("category").
+		Scan(&byType).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range byType {
+		report.ByType[row.Category] = row.Used
+	}
+
+	// By conversation: each content once per chat, so a file forwarded to
+	// several chats shows up in each of them but only once in the total
+	var byChat []struct {
+		ChatID *uuid.UUID
+		Used   int64
+	}
+	distinct = s.files().Scopes(s.bySender(userID)).
+		Select("DISTINCT ON (messages.chat_id, " + contentKey + ") messages.chat_id, files.file_size")
+	err = s.db.Table("(?) AS owned", distinct).
+		Select("chat_id, SUM(file_size) AS used").
+		Group("chat_id").
+		Scan(&byChat).Error
+	if err != nil {
+		return nil, err
+	}
+
+	report.Chats = make([]ChatUsage, 0, len(byChat))
+	for _, row := range byChat {
+		if row.ChatID == nil {
+			report.Direct = row.Used
+			continue
+		}
+
+		var chat models.Chat
+		if err := s.db.Select("id", "name").Where("id = ?", *row.ChatID).First(&chat).Error; err != nil {
+			// Deleted chats no longer count towards anything visible
+			continue
+		}
+		chatUsage, err := s.ChatUsage(chat.ID)
+		if err != nil {
+			return nil, err
+		}
+		report.Chats = append(report.Chats, ChatUsage{
+			ChatID: chat.ID,
+			Name:   chat.Name,
+			Used:   row.Used,
+			Chat:   *chatUsage,
+		})
+	}
+
+	return report, nil
+}
+
+// usage sums the distinct contents matched by owned
+func (s *Service) usage(owned func(*gorm.DB) *gorm.DB) (*Usage, error) {
+	var usage Usage
+	distinct := s.files().Scopes(owned).
+		Select("DISTINCT ON (" + contentKey + ") files.file_size")
+	err := s.db.Table("(?) AS owned", distinct).
+		Select("COALESCE(SUM(file_size), 0) AS used, COUNT(*) AS files").
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (s *Service) files() *gorm.DB {
+	return s.db.Table("files").
+		Joins("JOIN messages ON messages.id = files.message_id AND messages.deleted_at IS NULL")
+}
+
+func (s *Service) bySender(userID uuid.UUID) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("messages.sender_id = ?", userID)
+	}
+}
+
+func (s *Service) inChat(chatID uuid.UUID) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("messages.chat_id = ?", chatID)
+	}
+}
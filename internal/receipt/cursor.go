@@ -0,0 +1,380 @@
+package receipt
+
+import (
+	"errors"
+	"log"
+	"time"
+	"messenger/internal/websocket"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// readBatchSize bounds how many messages are marked read per round trip
+// when a cursor jumps over a long backlog
+const readBatchSize = 500
+
+var (
+	ErrNotMember           = errors.New("user is not a member of the chat")
+	ErrNotInConversation   = errors.New("message does not belong to the conversation")
+	ErrInvalidConversation = errors.New("exactly one of chat_id or peer_id is required")
+)
+
+// Conversation identifies either a chat or the direct conversation with a
+// peer
+type Conversation struct {
+	ChatID *uuid.UUID `json:"chat_id,omitempty"`
+	PeerID *uuid.UUID `json:"peer_id,omitempty"`
+}
+
+// UnreadCount is the read state of one conversation for one user
+type UnreadCount struct {
+	Conversation
+	UnreadCount       int64      `json:"unread_count"`
+	LastReadMessageID *uuid.UUID `json:"last_read_message_id"`
+}
+
+// MessagesReadPayload is the data of a messages_read event. It is sent to
+// each sender whose messages were covered when a reader moved its cursor.
+type MessagesReadPayload struct {
+	ChatID   *uuid.UUID                         `json:"chat_id"`
+	UserID   uuid.UUID                          `json:"user_id"`
+	Statuses map[uuid.UUID]models.MessageStatus `json:"statuses"`
+	ReadAt   time.Time                          `json:"read_at"`
+}
+
+// readCursor is the stored position of a user in a conversation. Messages
+// after since count as unread while nothing has been read yet.
+type readCursor struct {
+	messageID *uuid.UUID
+	readAt    *time.Time
+	since     time.Time
+}
+
+func (c *readCursor) start() time.Time {
+	if c.readAt != nil {
+		return *c.readAt
+	}
+	return c.since
+}
+
+// MarkReadUpTo moves the user's cursor in a conversation to messageID and
+// records a read receipt for every message it passes over. The cursor never
+// moves backwards. Senders get one messages_read event each and the reader's
+// own devices get the new unread count.
+func (s *Service) MarkReadUpTo(userID uuid.UUID, conversation Conversation, messageID uuid.UUID) (*UnreadCount, error) {
+	if (conversation.ChatID == nil) == (conversation.PeerID == nil) {
+		return nil, ErrInvalidConversation
+	}
+
+	var target models.Message
+	if err := s.db.Where("id = ?", messageID).First(&target).Error; err != nil {
+		return nil, err
+	}
+	if !conversation.contains(&target, userID) {
+		return nil, ErrNotInConversation
+	}
+
+	cursor, err := s.loadCursor(userID, conversation)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.readAt != nil && !target.CreatedAt.After(*cursor.readAt) {
+		return s.unreadCount(userID, conversation, cursor)
+	}
+
+	now := time.Now()
+	bySender := make(map[uuid.UUID]map[uuid.UUID]models.MessageStatus)
+
+	var batch []models.Message
+	err = s.incoming(userID, conversation).
+		Where("created_at > ? AND created_at <= ?", cursor.start(), target.CreatedAt).
+		FindInBatches(&batch, readBatchSize, func(tx *gorm.DB, _ int) error {
+			deliveries := make([]models.MessageDelivery, len(batch))
+			reads := make([]models.MessageRead, len(batch))
+			for i, message := range batch {
+				deliveries[i] = models.MessageDelivery{MessageID: message.ID, UserID: userID, DeliveredAt: now}
+				reads[i] = models.MessageRead{MessageID: message.ID, UserID: userID, ReadAt: now}
+			}
+			if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveries).Error; err != nil {
+				return err
+			}
+			if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reads).Error; err != nil {
+				return err
+			}
+
+			statuses, err := s.refreshStatuses(batch)
+			if err != nil {
+				return err
+			}
+			for _, message := range batch {
+				if bySender[message.SenderID] == nil {
+					bySender[message.SenderID] = make(map[uuid.UUID]models.MessageStatus)
+				}
+				bySender[message.SenderID][message.ID] = statuses[message.ID]
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	cursor.messageID = &target.ID
+	cursor.readAt = &target.CreatedAt
+	saved, err := s.saveCursor(userID, conversation, cursor)
+	if err != nil {
+		return nil, err
+	}
+	if !saved {
+		// A concurrent request moved the cursor further; count from there
+		if cursor, err = s.loadCursor(userID, conversation); err != nil {
+			return nil, err
+		}
+	}
+
+	for senderID, statuses := range bySender {
+		s.publisher.PublishToUsers([]uuid.UUID{senderID}, websocket.MessageTypeMessagesRead, userID, MessagesReadPayload{
+			ChatID:   conversation.ChatID,
+			UserID:   userID,
+			Statuses: statuses,
+			ReadAt:   now,
+		})
+	}
+
+	count, err := s.unreadCount(userID, conversation, cursor)
+	if err != nil {
+		return nil, err
+	}
+	s.publisher.PublishToUsers([]uuid.UUID{userID}, websocket.MessageTypeUnreadCount, userID, count)
+	return count, nil
+}
+
+// PublishUnreadCounts sends every recipient of message their unread count
+// in its conversation. It is called whenever a message is sent or deleted;
+// readers get their own count from MarkReadUpTo.
+func (s *Service) PublishUnreadCounts(message *models.Message) {
+	if message.ChatID != nil {
+		var rows []struct {
+			UserID            uuid.UUID
+			LastReadMessageID *uuid.UUID
+			UnreadCount       int64
+		}
+		err := s.db.Table("chat_members AS cm").
+			Select("cm.user_id, cm.last_read_message_id, COUNT(m.id) AS unread_count").
+			Joins("LEFT JOIN messages m ON m.chat_id = cm.chat_id AND m.sender_id <> cm.user_id AND m.deleted_at IS NULL AND m.created_at > COALESCE(cm.last_read_at, cm.created_at)").
+			Where("cm.chat_id = ? AND cm.is_active = ? AND cm.user_id <> ?", *message.ChatID, true, message.SenderID).
+			Group("cm.user_id, cm.last_read_message_id").
+			Scan(&rows).Error
+		if err != nil {
+			log.Printf("Failed to count unread messages in chat %s: %v", *message.ChatID, err)
+			return
+		}
+
+		chatID := *message.ChatID
+		for _, row := range rows {
+			s.publisher.PublishToUsers([]uuid.UUID{row.UserID}, websocket.MessageTypeUnreadCount, message.SenderID, UnreadCount{
+				Conversation:      Conversation{ChatID: &chatID},
+				UnreadCount:       row.UnreadCount,
+				LastReadMessageID: row.LastReadMessageID,
+			})
+		}
+		return
+	}
+
+	if message.ReceiverID == nil || *message.ReceiverID == message.SenderID {
+		return
+	}
+
+	senderID := message.SenderID
+	conversation := Conversation{PeerID: &senderID}
+	cursor, err := s.loadCursor(*message.ReceiverID, conversation)
+	if err == nil {
+		var count *UnreadCount
+		if count, err = s.unreadCount(*message.ReceiverID, conversation, cursor); err == nil {
+			s.publisher.PublishToUsers([]uuid.UUID{*message.ReceiverID}, websocket.MessageTypeUnreadCount, message.SenderID, count)
+			return
+		}
+	}
+	log.Printf("Failed to count unread messages from %s for %s: %v", message.SenderID, *message.ReceiverID, err)
+}
+
+// ChatUnreadCounts returns the read state of every chat the user is an
+// active member of, keyed by chat id
+func (s *Service) ChatUnreadCounts(userID uuid.UUID) (map[uuid.UUID]UnreadCount, error) {
+	var members []models.ChatMember
+	err := s.db.Where("user_id = ? AND is_active = ?", userID, true).Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ChatID      uuid.UUID
+		UnreadCount int64
+	}
+	err = s.db.Table("messages AS m").
+		Select("m.chat_id, COUNT(*) AS unread_count").
+		Joins("JOIN chat_members cm ON cm.chat_id = m.chat_id").
+		Where("cm.user_id = ? AND cm.is_active = ?", userID, true).
+		Where("m.sender_id <> ? AND m.deleted_at IS NULL", userID).
+		Where("m.created_at > COALESCE(cm.last_read_at, cm.created_at)").
+		Group("m.chat_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uuid.UUID]UnreadCount, len(members))
+	for _, member := range members {
+		chatID := member.ChatID
+		counts[chatID] = UnreadCount{
+			Conversation:      Conversation{ChatID: &chatID},
+			LastReadMessageID: member.LastReadMessageID,
+		}
+	}
+	for _, row := range rows {
+		if count, ok := counts[row.ChatID]; ok {
+			count.UnreadCount = row.UnreadCount
+			counts[row.ChatID] = count
+		}
+	}
+	return counts, nil
+}
+
+// DirectUnreadCounts returns the read state of every direct conversation
+// that has unread messages or a stored cursor
+func (s *Service) DirectUnreadCounts(userID uuid.UUID) ([]UnreadCount, error) {
+	var cursors []models.DirectReadCursor
+	if err := s.db.Where("user_id = ?", userID).Find(&cursors).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		PeerID      uuid.UUID
+		UnreadCount int64
+	}
+	err := s.db.Table("messages AS m").
+		Select("m.sender_id AS peer_id, COUNT(*) AS unread_count").
+		Joins("LEFT JOIN direct_read_cursors c ON c.user_id = m.receiver_id AND c.peer_id = m.sender_id").
+		Where("m.receiver_id = ? AND m.sender_id <> ? AND m.deleted_at IS NULL", userID, userID).
+		Where("c.last_read_at IS NULL OR m.created_at > c.last_read_at").
+		Group("m.sender_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byPeer := make(map[uuid.UUID]*UnreadCount, len(cursors)+len(rows))
+	counts := make([]UnreadCount, 0, len(cursors)+len(rows))
+	for _, cursor := range cursors {
+		peerID := cursor.PeerID
+		counts = append(counts, UnreadCount{
+			Conversation:      Conversation{PeerID: &peerID},
+			LastReadMessageID: cursor.LastReadMessageID,
+		})
+	}
+	for i := range counts {
+		byPeer[*counts[i].PeerID] = &counts[i]
+	}
+	for _, row := range rows {
+		if count, ok := byPeer[row.PeerID]; ok {
+			count.UnreadCount = row.UnreadCount
+			continue
+		}
+		peerID := row.PeerID
+		counts = append(counts, UnreadCount{
+			Conversation: Conversation{PeerID: &peerID},
+			UnreadCount:  row.UnreadCount,
+		})
+	}
+	return counts, nil
+}
+
+// contains reports whether the message belongs to the conversation as seen
+// by userID
+func (c Conversation) contains(message *models.Message, userID uuid.UUID) bool {
+	if c.ChatID != nil {
+		return message.ChatID != nil && *message.ChatID == *c.ChatID
+	}
+	if message.ReceiverID == nil {
+		return false
+	}
+	return (message.SenderID == *c.PeerID && *message.ReceiverID == userID) ||
+		(message.SenderID == userID && *message.ReceiverID == *c.PeerID)
+}
+
+// incoming selects the messages of a conversation sent to userID by others
+func (s *Service) incoming(userID uuid.UUID, conversation Conversation) *gorm.DB {
+	query := s.db.Model(&models.Message{})
+	if conversation.ChatID != nil {
+		return query.Where("chat_id = ? AND sender_id <> ?", *conversation.ChatID, userID)
+	}
+	return query.Where("sender_id = ? AND receiver_id = ?", *conversation.PeerID, userID)
+}
+
+func (s *Service) unreadCount(userID uuid.UUID, conversation Conversation, cursor *readCursor) (*UnreadCount, error) {
+	count := &UnreadCount{Conversation: conversation, LastReadMessageID: cursor.messageID}
+	err := s.incoming(userID, conversation).
+		Where("created_at > ?", cursor.start()).
+		Count(&count.UnreadCount).Error
+	if err != nil {
+		return nil, err
+	}
+	return count, nil
+}
+
+func (s *Service) loadCursor(userID uuid.UUID, conversation Conversation) (*readCursor, error) {
+	if conversation.ChatID != nil {
+		var member models.ChatMember
+		err := s.db.Where("chat_id = ? AND user_id = ? AND is_active = ?", *conversation.ChatID, userID, true).
+			First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotMember
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &readCursor{messageID: member.LastReadMessageID, readAt: member.LastReadAt, since: member.CreatedAt}, nil
+	}
+
+	var stored models.DirectReadCursor
+	err := s.db.Where("user_id = ? AND peer_id = ?", userID, *conversation.PeerID).First(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &readCursor{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &readCursor{messageID: stored.LastReadMessageID, readAt: stored.LastReadAt}, nil
+}
+
+// saveCursor stores cursor unless the stored one is already further along,
+// which happens when two mark-read requests race. It reports whether the
+// cursor was stored.
+func (s *Service) saveCursor(userID uuid.UUID, conversation Conversation, cursor *readCursor) (bool, error) {
+	if conversation.ChatID != nil {
+		result := s.db.Model(&models.ChatMember{}).
+			Where("chat_id = ? AND user_id = ? AND is_active = ?", *conversation.ChatID, userID, true).
+			Where("last_read_at IS NULL OR last_read_at < ?", cursor.readAt).
+			Updates(map[string]interface{}{
+				"last_read_message_id": cursor.messageID,
+				"last_read_at":         cursor.readAt,
+			})
+		return result.RowsAffected > 0, result.Error
+	}
+
+	stored := models.DirectReadCursor{
+		UserID:            userID,
+		PeerID:            *conversation.PeerID,
+		LastReadMessageID: cursor.messageID,
+		LastReadAt:        cursor.readAt,
+	}
+	result := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "peer_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_read_message_id", "last_read_at", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "direct_read_cursors.last_read_at IS NULL OR direct_read_cursors.last_read_at < excluded.last_read_at"},
+		}},
+	}).Create(&stored)
+	return result.RowsAffected > 0, result.Error
+}
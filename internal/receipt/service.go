@@ -0,0 +1,290 @@
+package receipt
+
+import (
+	"time"
+	"messenger/internal/websocket"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Service tracks when every recipient of a message received and read it and
+// keeps Message.Status in line with the slowest recipient
+type Service struct {
+	db        *gorm.DB
+	publisher websocket.Publisher
+}
+
+// Receipt is the delivery state of a message for a single recipient
+type Receipt struct {
+	UserID      uuid.UUID  `json:"user_id"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+}
+
+// StatusPayload is the data of message_delivered and message_read events.
+// Status is the aggregated status of the message after the change.
+type StatusPayload struct {
+	MessageID uuid.UUID            `json:"message_id"`
+	ChatID    *uuid.UUID           `json:"chat_id"`
+	UserID    uuid.UUID            `json:"user_id"`
+	Status    models.MessageStatus `json:"status"`
+	At        time.Time            `json:"at"`
+}
+
+var statusRank = map[models.MessageStatus]int{
+	models.MessageStatusSent:      1,
+	models.MessageStatusDelivered: 2,
+	models.MessageStatusRead:      3,
+}
+
+func NewService(db *gorm.DB, publisher websocket.Publisher) *Service {
+	return &Service{
+		db:        db,
+		publisher: publisher,
+	}
+}
+
+// MarkDelivered records that a message reached one of the user's devices.
+// Repeated calls and calls for the sender are no-ops.
+func (s *Service) MarkDelivered(messageID, userID uuid.UUID) error {
+	var message models.Message
+	if err := s.db.Where("id = ?", messageID).First(&message).Error; err != nil {
+		return err
+	}
+	if message.SenderID == userID {
+		return nil
+	}
+
+	now := time.Now()
+	created, err := s.recordDelivery(messageID, userID, now)
+	if err != nil || !created {
+		return err
+	}
+
+	return s.notify(&message, websocket.MessageTypeMessageDelivered, userID, now)
+}
+
+// MarkRead records that the user has read a message. A read message counts
+// as delivered too. The caller is expected to have checked access.
+func (s *Service) MarkRead(messageID, userID uuid.UUID) error {
+	var message models.Message
+	if err := s.db.Where("id = ?", messageID).First(&message).Error; err != nil {
+		return err
+	}
+	if message.SenderID == userID {
+		return nil
+	}
+
+	now := time.Now()
+	if _, err := s.recordDelivery(messageID, userID, now); err != nil {
+		return err
+	}
+
+	read := models.MessageRead{MessageID: messageID, UserID: userID, ReadAt: now}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&read)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	return s.notify(&message, websocket.MessageTypeMessageRead, userID, now)
+}
+
+// GetReceipts returns the delivery state of a message for every recipient
+func (s *Service) GetReceipts(message *models.Message) ([]Receipt, error) {
+	audience, err := s.audience(message)
+	if err != nil {
+		return nil, err
+	}
+	recipients := make([]uuid.UUID, 0, len(audience))
+	for _, userID := range audience {
+		if userID != message.SenderID {
+			recipients = append(recipients, userID)
+		}
+	}
+
+	var deliveries []models.MessageDelivery
+	if err := s.db.Where("message_id = ?", message.ID).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	var reads []models.MessageRead
+	if err := s.db.Where("message_id = ?", message.ID).Find(&reads).Error; err != nil {
+		return nil, err
+	}
+
+	receipts := make(map[uuid.UUID]*Receipt, len(recipients))
+	result := make([]Receipt, len(recipients))
+	for i, userID := range recipients {
+		result[i].UserID = userID
+		receipts[userID] = &result[i]
+	}
+	for i := range deliveries {
+		if r, ok := receipts[deliveries[i].UserID]; ok {
+			r.DeliveredAt = &deliveries[i].DeliveredAt
+		}
+	}
+	for i := range reads {
+		if r, ok := receipts[reads[i].UserID]; ok {
+			r.ReadAt = &reads[i].ReadAt
+		}
+	}
+
+	return result, nil
+}
+
+func (s *Service) recordDelivery(messageID, userID uuid.UUID, at time.Time) (bool, error) {
+	delivery := models.MessageDelivery{MessageID: messageID, UserID: userID, DeliveredAt: at}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery)
+	return result.RowsAffected > 0, result.Error
+}
+
+// notify refreshes the aggregated status and tells the sender, and only the
+// sender, about the new receipt
+func (s *Service) notify(message *models.Message, eventType string, userID uuid.UUID, at time.Time) error {
+	statuses, err := s.refreshStatuses([]models.Message{*message})
+	if err != nil {
+		return err
+	}
+
+	s.publisher.PublishToUsers([]uuid.UUID{message.SenderID}, eventType, userID, StatusPayload{
+		MessageID: message.ID,
+		ChatID:    message.ChatID,
+		UserID:    userID,
+		Status:    statuses[message.ID],
+		At:        at,
+	})
+	return nil
+}
+
+// refreshStatuses recomputes Message.Status from the receipts: delivered
+// once every recipient has it, read once every recipient has read it. The
+// status never moves backwards, e.g. when a member joins a group later. It
+// returns the resulting status of every message.
+func (s *Service) refreshStatuses(messages []models.Message) (map[uuid.UUID]models.MessageStatus, error) {
+	statuses := make(map[uuid.UUID]models.MessageStatus, len(messages))
+
+	// Messages addressed to the same chat or user share their audience
+	groups := make(map[uuid.UUID][]*models.Message)
+	for i := range messages {
+		message := &messages[i]
+		statuses[message.ID] = message.Status
+		switch {
+		case message.ChatID != nil:
+			groups[*message.ChatID] = append(groups[*message.ChatID], message)
+		case message.ReceiverID != nil:
+			groups[*message.ReceiverID] = append(groups[*message.ReceiverID], message)
+		}
+	}
+
+	updates := make(map[models.MessageStatus][]uuid.UUID)
+	for _, group := range groups {
+		audience, err := s.audience(group[0])
+		if err != nil {
+			return statuses, err
+		}
+		if len(audience) == 0 {
+			continue
+		}
+
+		ids := make([]uuid.UUID, len(group))
+		for i, message := range group {
+			ids[i] = message.ID
+		}
+		delivered, err := s.countReceipts(&models.MessageDelivery{}, ids, audience)
+		if err != nil {
+			return statuses, err
+		}
+		read, err := s.countReceipts(&models.MessageRead{}, ids, audience)
+		if err != nil {
+			return statuses, err
+		}
+
+		for _, message := range group {
+			// The sender never gets receipts for its own message
+			needed := int64(len(audience))
+			for _, userID := range audience {
+				if userID == message.SenderID {
+					needed--
+				}
+			}
+			if needed == 0 {
+				continue
+			}
+
+			status := models.MessageStatusSent
+			switch {
+			case read[message.ID] >= needed:
+				status = models.MessageStatusRead
+			case delivered[message.ID] >= needed:
+				status = models.MessageStatusDelivered
+			}
+
+			if statusRank[status] > statusRank[message.Status] {
+				updates[status] = append(updates[status], message.ID)
+				statuses[message.ID] = status
+			}
+		}
+	}
+
+	for status, ids := range updates {
+		// Guard against a concurrent receipt having already moved it further
+		err := s.db.Model(&models.Message{}).
+			Where("id IN ? AND status IN ?", ids, lowerStatuses(status)).
+			Update("status", status).Error
+		if err != nil {
+			return statuses, err
+		}
+	}
+
+	return statuses, nil
+}
+
+// countReceipts counts receipts of the given kind per message, only taking
+// the listed users into account
+func (s *Service) countReceipts(model interface{}, messageIDs, userIDs []uuid.UUID) (map[uuid.UUID]int64, error) {
+	var rows []struct {
+		MessageID uuid.UUID
+		Count     int64
+	}
+	err := s.db.Model(model).
+		Select("message_id, COUNT(*) AS count").
+		Where("message_id IN ? AND user_id IN ?", messageIDs, userIDs).
+		Group("message_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uuid.UUID]int64, len(rows))
+	for _, row := range rows {
+		counts[row.MessageID] = row.Count
+	}
+	return counts, nil
+}
+
+// audience returns everyone a message is addressed to, the sender included
+// when it is a chat member
+func (s *Service) audience(message *models.Message) ([]uuid.UUID, error) {
+	if message.ChatID != nil {
+		var memberIDs []uuid.UUID
+		err := s.db.Model(&models.ChatMember{}).
+			Where("chat_id = ? AND is_active = ?", *message.ChatID, true).
+			Pluck("user_id", &memberIDs).Error
+		return memberIDs, err
+	}
+	if message.ReceiverID != nil {
+		return []uuid.UUID{*message.ReceiverID}, nil
+	}
+	return nil, nil
+}
+
+func lowerStatuses(status models.MessageStatus) []models.MessageStatus {
+	var lower []models.MessageStatus
+	for s, rank := range statusRank {
+		if rank < statusRank[status] {
+			lower = append(lower, s)
+		}
+	}
+	return lower
+}
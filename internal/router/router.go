@@ -1,16 +1,24 @@
 package router
 
 import (
+	"time"
 	"messenger/internal/auth"
+	"messenger/internal/call"
 	"messenger/internal/config"
+	"messenger/internal/contact"
 	"messenger/internal/db"
 	"messenger/internal/handlers"
+	"messenger/internal/media"
 	"messenger/internal/middleware"
+	"messenger/internal/quota"
+	"messenger/internal/receipt"
+	"messenger/internal/storage"
+	"messenger/internal/upload"
 	"messenger/internal/websocket"
 	"github.com/gin-gonic/gin"
 )
 
-func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, database *db.Database) *gin.Engine {
+func Setup(authService *auth.Service, receiptService *receipt.Service, contactService *contact.Service, callService *call.Service, quotaService *quota.Service, fileStorage storage.Storage, uploadSessions *upload.Manager, mediaProcessor *media.Processor, hub *websocket.Hub, cfg *config.Config, database *db.Database) *gin.Engine {
 	if cfg.Server.Environment == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	}
@@ -22,8 +30,9 @@ func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, da
 	router.Use(gin.Recovery())
 	router.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, Range, Upload-Offset, Upload-Checksum")
+		c.Header("Access-Control-Expose-Headers", "Upload-Offset, Upload-Length, Content-Range, Accept-Ranges")
 		
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -34,13 +43,15 @@ func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, da
 	})
 
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(authService)
-	userHandler := handlers.NewUserHandler(database)
-	chatHandler := handlers.NewChatHandler(database)
-	messageHandler := handlers.NewMessageHandler(database)
-	contactHandler := handlers.NewContactHandler()
-	callHandler := handlers.NewCallHandler()
-	uploadHandler := handlers.NewUploadHandler()
+	authHandler := handlers.NewAuthHandler(authService, hub)
+	userHandler := handlers.NewUserHandler(database, quotaService, contactService, authService)
+	chatHandler := handlers.NewChatHandler(database, receiptService)
+	messageHandler := handlers.NewMessageHandler(database, hub, receiptService, contactService)
+	contactHandler := handlers.NewContactHandler(contactService)
+	callHandler := handlers.NewCallHandler(callService)
+	uploadHandler := handlers.NewUploadHandler(database, fileStorage, uploadSessions, mediaProcessor, quotaService, contactService, receiptService, hub, &cfg.File)
+	fileHandler := handlers.NewFileHandler(database, fileStorage,
+		storage.NewURLSigner(cfg.File.URLSecret, time.Duration(cfg.File.URLTTL)*time.Minute))
 
 	// Health check
 	router.GET("/health", func(c *gin.Context) {
@@ -66,9 +77,17 @@ func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, da
 		{
 			auth.POST("/register", authHandler.Register)
 			auth.POST("/login", authHandler.Login)
+			auth.POST("/refresh", authHandler.Refresh)
 			auth.POST("/logout", middleware.AuthMiddleware(authService), authHandler.Logout)
+			auth.POST("/verify-email", authHandler.VerifyEmail)
+			auth.POST("/verify-email/resend", middleware.AuthMiddleware(authService), authHandler.ResendVerification)
+			auth.POST("/password/forgot", authHandler.ForgotPassword)
+			auth.POST("/password/reset", authHandler.ResetPassword)
 		}
 
+		// File download: bearer token or signed link, so it sits outside the protected group
+		api.GET("/files/:id", middleware.OptionalAuthMiddleware(authService), fileHandler.DownloadFile)
+
 		// Protected routes
 		protected := api.Group("/")
 		protected.Use(middleware.AuthMiddleware(authService))
@@ -77,6 +96,13 @@ func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, da
 			users := protected.Group("/users")
 			{
 				users.GET("/me", userHandler.GetMe)
+				users.GET("/me/storage", userHandler.GetStorageUsage)
+				users.GET("/me/sessions", authHandler.GetSessions)
+				users.DELETE("/me/sessions", authHandler.RevokeOtherSessions)
+				users.DELETE("/me/sessions/:id", authHandler.RevokeSession)
+				users.PUT("/me/password", authHandler.ChangePassword)
+				users.GET("/me/call-settings", callHandler.GetCallSettings)
+				users.PUT("/me/call-settings", callHandler.UpdateCallSettings)
 				users.GET("/", userHandler.GetUsers)
 				users.GET("/:id", userHandler.GetUser)
 				users.PUT("/me", userHandler.UpdateMe)
@@ -100,10 +126,14 @@ func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, da
 			{
 				messages.GET("/", messageHandler.GetMessages)
 				messages.POST("/", messageHandler.SendMessage)
+				messages.GET("/search", messageHandler.SearchMessages)
+				messages.GET("/unread", messageHandler.GetUnreadCounts)
+				messages.POST("/read", messageHandler.MarkConversationRead)
 				messages.GET("/:id", messageHandler.GetMessage)
 				messages.PUT("/:id", messageHandler.UpdateMessage)
 				messages.DELETE("/:id", messageHandler.DeleteMessage)
 				messages.POST("/:id/read", messageHandler.MarkMessageAsRead)
+				messages.GET("/:id/receipts", messageHandler.GetMessageReceipts)
 			}
 
 			// Contact routes
@@ -111,7 +141,15 @@ func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, da
 			{
 				contacts.GET("/", contactHandler.GetContacts)
 				contacts.POST("/", contactHandler.AddContact)
+				contacts.GET("/requests", contactHandler.GetContactRequests)
+				contacts.GET("/blocked", contactHandler.GetBlockedContacts)
+				contacts.POST("/match", contactHandler.MatchContacts)
+				contacts.POST("/import", contactHandler.ImportContacts)
+				contacts.GET("/export", contactHandler.ExportContacts)
+				contacts.PUT("/:id", contactHandler.UpdateContact)
 				contacts.DELETE("/:id", contactHandler.RemoveContact)
+				contacts.PUT("/:id/accept", contactHandler.AcceptContact)
+				contacts.PUT("/:id/decline", contactHandler.DeclineContact)
 				contacts.PUT("/:id/block", contactHandler.BlockContact)
 				contacts.PUT("/:id/unblock", contactHandler.UnblockContact)
 			}
@@ -121,13 +159,34 @@ func Setup(authService *auth.Service, hub *websocket.Hub, cfg *config.Config, da
 			{
 				calls.GET("/", callHandler.GetCalls)
 				calls.POST("/", callHandler.InitiateCall)
+				calls.POST("/group", callHandler.StartGroupCall)
+				calls.GET("/ice-servers", callHandler.GetICEServers)
 				calls.PUT("/:id/answer", callHandler.AnswerCall)
 				calls.PUT("/:id/reject", callHandler.RejectCall)
 				calls.PUT("/:id/end", callHandler.EndCall)
+				calls.PUT("/:id/join", callHandler.JoinCall)
+				calls.PUT("/:id/leave", callHandler.LeaveCall)
+				calls.PUT("/:id/media", callHandler.UpdateCallMedia)
+				calls.PUT("/:id/screen-share", callHandler.SetScreenShare)
+				calls.PUT("/:id/participants/:user_id/mute", callHandler.MuteCallParticipant)
+				calls.DELETE("/:id/participants/:user_id", callHandler.RemoveCallParticipant)
 			}
 
 			// File upload
 			protected.POST("/upload", uploadHandler.UploadFile)
+
+			// Signed download links
+			protected.POST("/files/:id/url", fileHandler.GetFileURL)
+
+			// Resumable uploads
+			uploads := protected.Group("/uploads")
+			{
+				uploads.POST("/", uploadHandler.CreateUploadSession)
+				uploads.GET("/:id", uploadHandler.GetUploadSession)
+				uploads.PATCH("/:id", uploadHandler.UploadChunk)
+				uploads.POST("/:id/complete", uploadHandler.CompleteUploadSession)
+				uploads.DELETE("/:id", uploadHandler.AbortUploadSession)
+			}
 		}
 	}
 
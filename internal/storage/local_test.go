@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStoragePutOpenDelete(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	key := "2024/05/01/file.txt"
+	if err := s.Put(ctx, key, strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "2024", "05", "01", "file.txt")); err != nil {
+		t.Fatalf("blob is not below the root: %v", err)
+	}
+
+	file, err := s.Open(ctx, key)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("read %q, %v; want hello", content, err)
+	}
+
+	// Overwriting replaces the blob as a whole
+	if err := s.Put(ctx, key, strings.NewReader("bye"), 3, "text/plain"); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	file, err = s.Open(ctx, key)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	content, _ = io.ReadAll(file)
+	file.Close()
+	if string(content) != "bye" {
+		t.Fatalf("read %q after overwrite, want bye", content)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Open(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("open after delete: got %v, want ErrNotFound", err)
+	}
+	// Deleting twice is not an error
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("second delete: %v", err)
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Join(root, "2024", "05", "01"))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("left %d files behind", len(entries))
+	}
+}
+
+func TestLocalStorageOpenMissing(t *testing.T) {
+	s, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	if _, err := s.Open(context.Background(), "missing.txt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalStorageRejectsKeysOutsideRoot(t *testing.T) {
+	ctx := context.Background()
+	parent := t.TempDir()
+	root := filepath.Join(parent, "uploads")
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatalf("new storage: %v", err)
+	}
+
+	secret := filepath.Join(parent, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+
+	keys := []string{
+		"",
+		".",
+		"..",
+		"../secret.txt",
+		"a/../../secret.txt",
+		"/etc/passwd",
+	}
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			if err := s.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+				t.Error("put accepted the key")
+			}
+			if file, err := s.Open(ctx, key); err == nil {
+				file.Close()
+				t.Error("open accepted the key")
+			}
+			if err := s.Delete(ctx, key); err == nil {
+				t.Error("delete accepted the key")
+			}
+		})
+	}
+
+	if content, err := os.ReadFile(secret); err != nil || string(content) != "secret" {
+		t.Fatalf("file outside the root was touched: %q, %v", content, err)
+	}
+
+	// Dots inside a key that stays below the root are fine
+	if err := s.Put(ctx, "a/../b/file.txt", strings.NewReader("x"), 1, "text/plain"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b", "file.txt")); err != nil {
+		t.Fatalf("blob not stored below the root: %v", err)
+	}
+}
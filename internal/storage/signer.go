@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"time"
+	"github.com/google/uuid"
+)
+
+// URLSigner mints and checks short-lived download links. A link is bound to
+// the file and to the user who requested it, so access can be re-checked
+// when it is used.
+type URLSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewURLSigner(secret string, ttl time.Duration) *URLSigner {
+	return &URLSigner{secret: []byte(secret), ttl: ttl}
+}
+
+// Sign returns the query parameters that authorize userID to fetch fileID
+// until the returned expiry
+func (s *URLSigner) Sign(fileID, userID uuid.UUID) (url.Values, time.Time) {
+	expires := time.Now().Add(s.ttl).Truncate(time.Second)
+
+	query := url.Values{}
+	query.Set("uid", userID.String())
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", s.signature(fileID, userID, expires.Unix()))
+	return query, expires
+}
+
+// Verify checks the query parameters of a signed link and returns the user
+// it was minted for
+func (s *URLSigner) Verify(fileID uuid.UUID, query url.Values) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(query.Get("uid"))
+	if err != nil {
+		return uuid.Nil, false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return uuid.Nil, false
+	}
+
+	expected := s.signature(fileID, userID, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func (s *URLSigner) signature(fileID, userID uuid.UUID, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(fileID.String() + "|" + userID.String() + "|" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,298 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"messenger/internal/config"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxChunkSize bounds a single PATCH so a request never holds more than this
+// much in flight
+const MaxChunkSize = 16 * 1024 * 1024
+
+var (
+	ErrSessionNotFound  = errors.New("upload session not found")
+	ErrSessionExpired   = errors.New("upload session expired")
+	ErrSessionCompleted = errors.New("upload session already completed")
+	ErrOffsetMismatch   = errors.New("offset does not match the uploaded size")
+	ErrChunkTooLarge    = errors.New("chunk exceeds the declared file size or chunk limit")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrIncomplete       = errors.New("upload is not complete")
+	ErrTooLarge         = errors.New("file exceeds the maximum upload size")
+)
+
+// Manager keeps track of resumable upload sessions. Chunks are staged in a
+// local directory, so every request of a session has to reach the same
+// server instance.
+type Manager struct {
+	db      *gorm.DB
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+
+	mutex sync.Mutex
+	locks map[uuid.UUID]*sync.Mutex
+}
+
+func NewManager(db *gorm.DB, cfg *config.FileConfig) (*Manager, error) {
+	if err := os.MkdirAll(cfg.SessionPath, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create upload session directory: %w", err)
+	}
+
+	return &Manager{
+		db:      db,
+		dir:     cfg.SessionPath,
+		maxSize: cfg.MaxResumableSize,
+		ttl:     time.Duration(cfg.SessionTTL) * time.Hour,
+		locks:   make(map[uuid.UUID]*sync.Mutex),
+	}, nil
+}
+
+// MaxSize is the largest file a session may declare
+func (m *Manager) MaxSize() int64 {
+	return m.maxSize
+}
+
+// Create stores a new session and its empty staging file
+func (m *Manager) Create(session *models.UploadSession) error {
+	if session.FileSize <= 0 || session.FileSize > m.maxSize {
+		return ErrTooLarge
+	}
+
+	session.BytesReceived = 0
+	session.Status = models.UploadSessionPending
+	session.ExpiresAt = time.Now().Add(m.ttl)
+	if err := m.db.Create(session).Error; err != nil {
+		return err
+	}
+
+	file, err := os.Create(m.path(session.ID))
+	if err != nil {
+		m.db.Delete(session)
+		return fmt.Errorf("failed to create staging file: %w", err)
+	}
+	return file.Close()
+}
+
+// Get returns a session owned by userID
+func (m *Manager) Get(userID, sessionID uuid.UUID) (*models.UploadSession, error) {
+	var session models.UploadSession
+	err := m.db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Append writes a chunk at offset, which must equal the number of bytes
+// received so far. When checksum (hex SHA-256 of the chunk) is given the
+// chunk is verified and dropped on mismatch. Every accepted chunk extends
+// the session's expiry.
+func (m *Manager) Append(session *models.UploadSession, offset int64, chunk io.Reader, checksum string) error {
+	lock := m.lock(session.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Re-read under the lock; another request may have moved the offset
+	if err := m.db.First(session, session.ID).Error; err != nil {
+		return err
+	}
+	if err := m.checkPending(session); err != nil {
+		return err
+	}
+	if offset != session.BytesReceived {
+		return ErrOffsetMismatch
+	}
+
+	file, err := os.OpenFile(m.path(session.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open staging file: %w", err)
+	}
+	defer file.Close()
+
+	// Anything past the recorded offset is left over from a failed request
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate staging file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek staging file: %w", err)
+	}
+
+	limit := session.FileSize - offset
+	if limit > MaxChunkSize {
+		limit = MaxChunkSize
+	}
+
+	digest := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, digest), io.LimitReader(chunk, limit+1))
+	if err != nil {
+		file.Truncate(offset)
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	if written > limit {
+		file.Truncate(offset)
+		return ErrChunkTooLarge
+	}
+	if checksum != "" && !matches(digest, checksum) {
+		file.Truncate(offset)
+		return ErrChecksumMismatch
+	}
+
+	session.BytesReceived = offset + written
+	session.ExpiresAt = time.Now().Add(m.ttl)
+	return m.db.Model(session).Updates(map[string]interface{}{
+		"bytes_received": session.BytesReceived,
+		"expires_at":     session.ExpiresAt,
+	}).Error
+}
+
+// Finish hands the staged file to attach once every byte has arrived and
+// the whole-file checksum, if any, matches. The session is marked completed
+// and its staged data removed only when attach succeeds, so a failed
+// attempt can be retried.
+func (m *Manager) Finish(session *models.UploadSession, attach func(file *os.File) error) error {
+	lock := m.lock(session.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := m.db.First(session, session.ID).Error; err != nil {
+		return err
+	}
+	if err := m.checkPending(session); err != nil {
+		return err
+	}
+	if session.BytesReceived != session.FileSize {
+		return ErrIncomplete
+	}
+
+	file, err := os.Open(m.path(session.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open staging file: %w", err)
+	}
+	defer file.Close()
+
+	if session.Checksum != "" {
+		digest := sha256.New()
+		if _, err := io.Copy(digest, file); err != nil {
+			return fmt.Errorf("failed to read staging file: %w", err)
+		}
+		if !matches(digest, session.Checksum) {
+			return ErrChecksumMismatch
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek staging file: %w", err)
+		}
+	}
+
+	if err := attach(file); err != nil {
+		return err
+	}
+
+	session.Status = models.UploadSessionCompleted
+	if err := m.db.Model(session).Update("status", session.Status).Error; err != nil {
+		return err
+	}
+	m.removeStaging(session.ID)
+	return nil
+}
+
+// Abort deletes the session and its staged data
+func (m *Manager) Abort(session *models.UploadSession) error {
+	lock := m.lock(session.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := m.db.Delete(session).Error; err != nil {
+		return err
+	}
+	m.removeStaging(session.ID)
+	return nil
+}
+
+// RunCleanup periodically deletes sessions that expired before completing,
+// and completed sessions once they are past their expiry as well
+func (m *Manager) RunCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.cleanup()
+	}
+}
+
+func (m *Manager) cleanup() {
+	var expired []models.UploadSession
+	if err := m.db.Where("expires_at < ?", time.Now()).Find(&expired).Error; err != nil {
+		log.Printf("Failed to list expired upload sessions: %v", err)
+		return
+	}
+
+	for i := range expired {
+		if err := m.Abort(&expired[i]); err != nil {
+			log.Printf("Failed to remove upload session %s: %v", expired[i].ID, err)
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("Removed %d expired upload sessions", len(expired))
+	}
+}
+
+func (m *Manager) checkPending(session *models.UploadSession) error {
+	if session.Status == models.UploadSessionCompleted {
+		return ErrSessionCompleted
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return ErrSessionExpired
+	}
+	return nil
+}
+
+func (m *Manager) lock(sessionID uuid.UUID) *sync.Mutex {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lock, ok := m.locks[sessionID]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[sessionID] = lock
+	}
+	return lock
+}
+
+func (m *Manager) removeStaging(sessionID uuid.UUID) {
+	if err := os.Remove(m.path(sessionID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove staging file for %s: %v", sessionID, err)
+	}
+
+	m.mutex.Lock()
+	delete(m.locks, sessionID)
+	m.mutex.Unlock()
+}
+
+func (m *Manager) path(sessionID uuid.UUID) string {
+	return filepath.Join(m.dir, sessionID.String())
+}
+
+func matches(digest hash.Hash, checksum string) bool {
+	expected, err := hex.DecodeString(checksum)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(digest.Sum(nil), expected)
+}
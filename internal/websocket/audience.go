@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"errors"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+)
+
+var errAccessDenied = errors.New("access denied")
+
+// chatMemberIDs returns the users that are active members of a chat
+func (h *Hub) chatMemberIDs(chatID uuid.UUID) ([]uuid.UUID, error) {
+	var memberIDs []uuid.UUID
+	err := h.db.Model(&models.ChatMember{}).
+		Where("chat_id = ? AND is_active = ?", chatID, true).
+		Pluck("user_id", &memberIDs).Error
+	return memberIDs, err
+}
+
+// chatAudience returns the members of a chat after checking that userID may
+// post to it. Public chats accept events from anyone, other chats only from
+// active members.
+func (h *Hub) chatAudience(userID, chatID uuid.UUID) ([]uuid.UUID, error) {
+	var chat models.Chat
+	if err := h.db.Where("id = ? AND is_active = ?", chatID, true).First(&chat).Error; err != nil {
+		return nil, err
+	}
+
+	memberIDs, err := h.chatMemberIDs(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if chat.Type != models.ChatTypePublic && !containsUser(memberIDs, userID) {
+		return nil, errAccessDenied
+	}
+
+	return memberIDs, nil
+}
+
+// messageAudience returns the users that can see a stored message, provided
+// userID is one of them
+func (h *Hub) messageAudience(userID, messageID uuid.UUID) ([]uuid.UUID, error) {
+	var message models.Message
+	if err := h.db.Where("id = ?", messageID).First(&message).Error; err != nil {
+		return nil, err
+	}
+
+	if message.ChatID != nil {
+		memberIDs, err := h.chatMemberIDs(*message.ChatID)
+		if err != nil {
+			return nil, err
+		}
+		if !containsUser(memberIDs, userID) {
+			return nil, errAccessDenied
+		}
+		return memberIDs, nil
+	}
+
+	if message.ReceiverID != nil {
+		if message.SenderID != userID && *message.ReceiverID != userID {
+			return nil, errAccessDenied
+		}
+		return []uuid.UUID{message.SenderID, *message.ReceiverID}, nil
+	}
+
+	return nil, errAccessDenied
+}
+
+// blockedBy returns the users userID has blocked
+func (h *Hub) blockedBy(userID uuid.UUID) ([]uuid.UUID, error) {
+	var blocked []uuid.UUID
+	err := h.db.Model(&models.Contact{}).
+		Where("user_id = ? AND is_blocked = ?", userID, true).
+		Pluck("contact_id", &blocked).Error
+	return blocked, err
+}
+
+// directAudience returns both sides of a direct conversation unless either
+// of them blocked the other
+func (h *Hub) directAudience(userID, receiverID uuid.UUID) ([]uuid.UUID, error) {
+	var blocks int64
+	err := h.db.Model(&models.Contact{}).
+		Where("is_blocked = ? AND ((user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?))",
+			true, userID, receiverID, receiverID, userID).
+		Count(&blocks).Error
+	if err != nil {
+		return nil, err
+	}
+	if blocks > 0 {
+		return nil, errAccessDenied
+	}
+
+	return []uuid.UUID{userID, receiverID}, nil
+}
+
+func containsUser(userIDs []uuid.UUID, userID uuid.UUID) bool {
+	for _, id := range userIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutUser(userIDs []uuid.UUID, userID uuid.UUID) []uuid.UUID {
+	result := make([]uuid.UUID, 0, len(userIDs))
+	for _, id := range userIDs {
+		if id != userID {
+			result = append(result, id)
+		}
+	}
+	return result
+}
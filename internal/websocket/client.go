@@ -5,14 +5,19 @@ import (
 	"encoding/json"
 	"log"
 	"time"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 const (
+	// closeTokenExpired closes connections whose access token ran out
+	// without an auth frame renewing it
+	closeTokenExpired = 4001
+
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxMessageSize = 16384
 )
 
 var (
@@ -84,6 +89,11 @@ func (c *Client) writePump() {
 
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if time.Now().Unix() >= c.authExpiry.Load() {
+				c.Conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(closeTokenExpired, "token expired"))
+				return
+			}
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -92,80 +102,164 @@ func (c *Client) writePump() {
 }
 
 func (c *Client) handleIncomingMessage(message []byte) {
-	var msg Message
-	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Printf("Error unmarshaling message: %v", err)
+	var frame inboundFrame
+	if err := json.Unmarshal(message, &frame); err != nil {
+		c.reject(&frame, newProtocolError(ErrorCodeInvalidJSON, "frame is not valid JSON"))
+		return
+	}
+
+	payload, err := decodePayload(&frame)
+	if err != nil {
+		c.reject(&frame, err)
 		return
 	}
 
-	// Set the user ID from the client
-	msg.UserID = c.UserID
-	msg.Timestamp = time.Now().Unix()
+	// The user ID always comes from the connection; sequence numbers are
+	// assigned by the hub
+	msg := &Message{
+		Type:      frame.Type,
+		Data:      payload,
+		UserID:    c.UserID,
+		Timestamp: time.Now().Unix(),
+	}
+
+	switch p := payload.(type) {
+	case *ChatPayload:
+		err = c.handleChatMessage(msg, p)
+	case *TypingPayload:
+		err = c.handleTypingMessage(msg, p)
+	case *CallSignalPayload:
+		err = c.handleCallSignal(msg, p)
+	case *MessageReadPayload:
+		err = c.handleMessageRead(p)
+	case *AckPayload:
+		c.Hub.acknowledge(c, p.Seq)
+	case *AuthPayload:
+		err = c.handleAuth(p)
+	}
+
+	if err != nil {
+		c.reject(&frame, err)
+		return
+	}
+	c.confirm(&frame)
+}
+
+func (c *Client) handleChatMessage(msg *Message, payload *ChatPayload) error {
+	// Relay to the chat members or both sides of the conversation
+	recipients, err := c.conversationAudience(payload.ChatID, payload.ReceiverID)
+	if err != nil {
+		return err
+	}
+
+	c.Hub.SendToUsers(recipients, msg)
+	return nil
+}
+
+func (c *Client) handleTypingMessage(msg *Message, payload *TypingPayload) error {
+	// Send typing indicator to the other side of the conversation
+	recipients, err := c.conversationAudience(payload.ChatID, payload.ReceiverID)
+	if err != nil {
+		return err
+	}
+
+	c.Hub.sendEphemeral(withoutUser(recipients, c.UserID), msg)
+	return nil
+}
+
+func (c *Client) handleCallSignal(msg *Message, payload *CallSignalPayload) error {
+	// Signaling only flows between participants of a call that is still on
+	peers, err := c.Hub.callPeers(c.UserID, payload)
+	if err != nil {
+		return err
+	}
 
+	// Rejections and hang-ups change the persisted call as well; the call
+	// service announces the new state with call_updated
 	switch msg.Type {
-	case MessageTypeChat:
-		c.handleChatMessage(&msg)
-	case MessageTypeTyping:
-		c.handleTypingMessage(&msg)
-	case MessageTypeCallOffer:
-		c.handleCallOffer(&msg)
-	case MessageTypeCallAnswer:
-		c.handleCallAnswer(&msg)
 	case MessageTypeCallReject:
-		c.handleCallReject(&msg)
+		_, err = c.Hub.calls.Reject(payload.CallID, c.UserID)
 	case MessageTypeCallEnd:
-		c.handleCallEnd(&msg)
-	case MessageTypeMessageRead:
-		c.handleMessageRead(&msg)
-	default:
-		log.Printf("Unknown message type: %s", msg.Type)
+		_, err = c.Hub.calls.End(payload.CallID, c.UserID)
+	}
+	if err != nil {
+		return newProtocolError(ErrorCodeInvalidState, err.Error())
 	}
-}
 
-func (c *Client) handleChatMessage(msg *Message) {
-	// Broadcast to all connected clients
-	data, _ := json.Marshal(msg)
-	c.Hub.broadcast <- data
+	// SDP and candidates are only useful right now, so they are not kept
+	// for replay to reconnecting devices
+	c.Hub.sendEphemeral(peers, msg)
+	return nil
 }
 
-func (c *Client) handleTypingMessage(msg *Message) {
-	// Broadcast typing indicator to other users
-	data, _ := json.Marshal(msg)
-	c.Hub.broadcast <- data
+func (c *Client) handleMessageRead(payload *MessageReadPayload) error {
+	// Only users who can see the message may mark it read; the tracker
+	// then notifies the sender
+	if _, err := c.Hub.messageAudience(c.UserID, payload.MessageID); err != nil {
+		return err
+	}
+	if c.Hub.receipts == nil {
+		return newProtocolError(ErrorCodeInternal, "read receipts are not available")
+	}
+
+	return c.Hub.receipts.MarkRead(payload.MessageID, c.UserID)
 }
 
-func (c *Client) handleCallOffer(msg *Message) {
-	// Handle call offer - send to specific user
-	if callData, ok := msg.Data.(map[string]interface{}); ok {
-		if _, ok := callData["target_user_id"].(string); ok {
-			// Send to specific user
-			data, _ := json.Marshal(msg)
-			// Implementation depends on how you want to handle direct messages
-			c.Hub.broadcast <- data
-		}
+func (c *Client) handleAuth(payload *AuthPayload) error {
+	// A new access token extends the connection; it must come from the
+	// same session the connection was opened with
+	claims, err := c.auth.ValidateToken(payload.Token)
+	if err != nil {
+		return newProtocolError(ErrorCodeUnauthorized, "invalid token")
+	}
+	if claims.UserID != c.UserID || claims.SessionID != c.sessionID {
+		return newProtocolError(ErrorCodeForbidden, "token belongs to another session")
 	}
-}
 
-func (c *Client) handleCallAnswer(msg *Message) {
-	// Handle call answer
-	data, _ := json.Marshal(msg)
-	c.Hub.broadcast <- data
+	c.authExpiry.Store(claims.ExpiresAt.Unix())
+	return nil
 }
 
-func (c *Client) handleCallReject(msg *Message) {
-	// Handle call rejection
-	data, _ := json.Marshal(msg)
-	c.Hub.broadcast <- data
+// conversationAudience resolves who should receive an event addressed to
+// either a chat or a direct conversation
+func (c *Client) conversationAudience(chatID, receiverID *uuid.UUID) ([]uuid.UUID, error) {
+	if chatID != nil {
+		return c.Hub.chatAudience(c.UserID, *chatID)
+	}
+	return c.Hub.directAudience(c.UserID, *receiverID)
 }
 
-func (c *Client) handleCallEnd(msg *Message) {
-	// Handle call end
-	data, _ := json.Marshal(msg)
-	c.Hub.broadcast <- data
+// reject reports a frame that could not be processed. Version 1 clients do
+// not understand error frames, so for them it is only logged.
+func (c *Client) reject(frame *inboundFrame, err error) {
+	protocolErr := toProtocolError(err)
+	protocolErr.Type = frame.Type
+	log.Printf("Rejected %q frame from %s: %v", frame.Type, c.UserID, err)
+
+	if c.protocol < ProtocolVersion2 {
+		return
+	}
+
+	c.Hub.sendToClient(c, &Message{
+		Type:          MessageTypeError,
+		Data:          protocolErr,
+		UserID:        c.UserID,
+		Timestamp:     getCurrentTimestamp(),
+		CorrelationID: frame.ID,
+	})
 }
 
-func (c *Client) handleMessageRead(msg *Message) {
-	// Handle message read receipt
-	data, _ := json.Marshal(msg)
-	c.Hub.broadcast <- data
-}
\ No newline at end of file
+// confirm answers a frame that carried a correlation id
+func (c *Client) confirm(frame *inboundFrame) {
+	if c.protocol < ProtocolVersion2 || frame.ID == "" {
+		return
+	}
+
+	c.Hub.sendToClient(c, &Message{
+		Type:          MessageTypeResult,
+		Data:          ResultPayload{Type: frame.Type},
+		UserID:        c.UserID,
+		Timestamp:     getCurrentTimestamp(),
+		CorrelationID: frame.ID,
+	})
+}
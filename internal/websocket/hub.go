@@ -2,11 +2,16 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"messenger/internal/auth"
+	"messenger/internal/broker"
 	"messenger/pkg/models"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -20,12 +25,29 @@ var upgrader = websocket.Upgrader{
 }
 
 type Hub struct {
-	clients    map[uuid.UUID]*Client
+	// clients holds every open connection per user, keyed by Client.ID,
+	// so the same user can be online from several devices at once
+	clients    map[uuid.UUID]map[uuid.UUID]*Client
+	// streams holds the resumable event feed of every device, including
+	// devices that are briefly disconnected
+	streams    map[uuid.UUID]map[uuid.UUID]*stream
 	register   chan *Client
 	unregister chan *Client
-	broadcast  chan []byte
+	direct     chan *directMessage
 	mutex      sync.RWMutex
 	db         *gorm.DB
+
+	// broker relays events between server instances; everything published
+	// comes back through receive and is queued in inbox for the Run loop
+	broker     broker.Broker
+	inbox      []*envelope
+	inboxReady chan struct{}
+	inboxMutex sync.Mutex
+
+	// receipts records delivery of new messages to connected devices
+	receipts ReceiptTracker
+	// calls resolves who takes part in a call for signaling
+	calls CallRegistry
 }
 
 type Client struct {
@@ -34,13 +56,42 @@ type Client struct {
 	Conn   *websocket.Conn
 	Send   chan []byte
 	UserID uuid.UUID
+
+	protocol int
+	resume   *resumeRequest
+	// sessionID is the sign-in the connection was authenticated with
+	sessionID uuid.UUID
+
+	// auth validates the access tokens of auth frames; authExpiry is when
+	// the current one runs out, as unix seconds
+	auth       *auth.Service
+	authExpiry atomic.Int64
+}
+
+// directMessage is an event addressed to a fixed set of users. Durable
+// events are sequenced and kept for replay; the rest (typing indicators)
+// only reach devices that are connected right now. A streamID other than
+// uuid.Nil limits delivery to that one device.
+type directMessage struct {
+	userIDs  []uuid.UUID
+	streamID uuid.UUID
+	message  *Message
+	durable  bool
 }
 
 type Message struct {
 	Type      string      `json:"type"`
+	Seq       uint64      `json:"seq,omitempty"`
 	Data      interface{} `json:"data"`
 	UserID    uuid.UUID   `json:"user_id"`
 	Timestamp int64       `json:"timestamp"`
+	// CorrelationID echoes the id of the client frame a reply belongs to
+	CorrelationID string  `json:"correlation_id,omitempty"`
+}
+
+func (m *Message) encode() []byte {
+	data, _ := json.Marshal(m)
+	return data
 }
 
 const (
@@ -51,84 +102,299 @@ const (
 	MessageTypeCallAnswer   = "call_answer"
 	MessageTypeCallReject   = "call_reject"
 	MessageTypeCallEnd      = "call_end"
+	MessageTypeICECandidate = "ice_candidate"
+	MessageTypeCallRenegotiate = "call_renegotiate"
+	MessageTypeCallUpdated  = "call_updated"
+	MessageTypeCallParticipantUpdated = "call_participant_updated"
 	MessageTypeNewMessage   = "new_message"
+	MessageTypeMessageUpdated = "message_updated"
+	MessageTypeMessageDeleted = "message_deleted"
 	MessageTypeMessageRead  = "message_read"
+	MessageTypeMessageDelivered = "message_delivered"
+	MessageTypeMessagesRead = "messages_read"
+	MessageTypeUnreadCount  = "unread_count"
 	MessageTypeUserJoined   = "user_joined"
 	MessageTypeUserLeft     = "user_left"
+	MessageTypeContactRequest  = "contact_request"
+	MessageTypeContactAccepted = "contact_accepted"
+	MessageTypeContactRemoved  = "contact_removed"
+	MessageTypeSession      = "session"
+	MessageTypeAck          = "ack"
+	MessageTypeAuth         = "auth"
+	MessageTypeSessionRevoked = "session_revoked"
+	MessageTypeError        = "error"
+	MessageTypeResult       = "result"
 )
 
-func NewHub(db *gorm.DB) *Hub {
+func NewHub(db *gorm.DB, eventBroker broker.Broker) *Hub {
 	return &Hub{
-		clients:    make(map[uuid.UUID]*Client),
+		clients:    make(map[uuid.UUID]map[uuid.UUID]*Client),
+		streams:    make(map[uuid.UUID]map[uuid.UUID]*stream),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		broadcast:  make(chan []byte),
+		direct:     make(chan *directMessage),
 		db:         db,
+		broker:     eventBroker,
+		inboxReady: make(chan struct{}, 1),
 	}
 }
 
+// subscribe attaches the hub to the broker. Every event, including the ones
+// for local connections, comes back through the broker, so a failed attempt
+// is retried with backoff in the background instead of being given up.
+func (h *Hub) subscribe() {
+	err := h.broker.Subscribe(h.receive)
+	if err == nil {
+		return
+	}
+
+	go func() {
+		delay := subscribeMinDelay
+		for err != nil && !errors.Is(err, broker.ErrClosed) {
+			log.Printf("Failed to subscribe to event broker, retrying in %s: %v", delay, err)
+			time.Sleep(delay)
+			delay = min(delay*2, subscribeMaxDelay)
+			err = h.broker.Subscribe(h.receive)
+		}
+		if err == nil {
+			log.Println("Subscribed to event broker")
+		}
+	}()
+}
+
+// SetReceiptTracker installs the tracker that is told about every stored
+// message handed to a recipient's device. It must be called before Run.
+func (h *Hub) SetReceiptTracker(tracker ReceiptTracker) {
+	h.receipts = tracker
+}
+
 func (h *Hub) Run() {
+	h.subscribe()
+
+	ticker := time.NewTicker(resumeWindow / 2)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mutex.Lock()
-			h.clients[client.UserID] = client
+			firstDevice, replaySince := h.attachStream(client)
 			h.mutex.Unlock()
-			
-			// Update user status to online
-			h.db.Model(&models.User{}).Where("id = ?", client.UserID).Update("status", models.StatusOnline)
-			
-			// Notify others about user joining
-			h.broadcastUserStatus(client.UserID, models.StatusOnline)
-			
-			log.Printf("Client %s connected", client.UserID)
+
+			log.Printf("Client %s connected (device %s)", client.UserID, client.ID)
+
+			if replaySince != nil {
+				go h.replayFromDatabase(client, *replaySince)
+			}
+
+			if firstDevice {
+				// Update user status to online
+				h.db.Model(&models.User{}).Where("id = ?", client.UserID).Updates(map[string]interface{}{
+					"status":       models.StatusOnline,
+					"heartbeat_at": time.Now(),
+				})
+				
+				// Notify others about user joining
+				h.broadcastUserStatus(client.UserID, models.StatusOnline)
+			}
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
-			if _, ok := h.clients[client.UserID]; ok {
-				delete(h.clients, client.UserID)
-				close(client.Send)
-				
+			h.removeClient(client)
+			lastDevice := len(h.clients[client.UserID]) == 0
+			h.mutex.Unlock()
+
+			log.Printf("Client %s disconnected (device %s)", client.UserID, client.ID)
+
+			if lastDevice {
 				// Update user status to offline
 				h.db.Model(&models.User{}).Where("id = ?", client.UserID).Update("status", models.StatusOffline)
 				
 				// Notify others about user leaving
 				h.broadcastUserStatus(client.UserID, models.StatusOffline)
-				
-				log.Printf("Client %s disconnected", client.UserID)
 			}
-			h.mutex.Unlock()
 
-		case message := <-h.broadcast:
-			h.mutex.RLock()
-			for _, client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client.UserID)
+		case <-h.inboxReady:
+			h.drainInbox()
+
+		case message := <-h.direct:
+			h.deliverTo(message)
+
+		case <-ticker.C:
+			h.expireStreams()
+
+		case <-heartbeat.C:
+			h.refreshPresence()
+		}
+	}
+}
+
+// deliverAll sends a frame to every connected client except the devices of
+// the listed users
+func (h *Hub) deliverAll(message []byte, except []uuid.UUID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for userID, devices := range h.clients {
+		if containsUser(except, userID) {
+			continue
+		}
+		for _, client := range devices {
+			h.deliver(client, message)
+		}
+	}
+}
+
+// deliverTo sends an event to every device of the listed users, skipping
+// duplicates. Durable events are sequenced per device stream so that
+// disconnected devices can have them replayed on resume.
+func (h *Hub) deliverTo(message *directMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var delivered []uuid.UUID
+	var ephemeral []byte
+	if !message.durable {
+		ephemeral = message.message.encode()
+	}
+
+	seen := make(map[uuid.UUID]bool, len(message.userIDs))
+	for _, userID := range message.userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		if !message.durable {
+			for id, client := range h.clients[userID] {
+				if message.streamID != uuid.Nil && message.streamID != id {
+					continue
 				}
+				h.deliver(client, ephemeral)
+			}
+			continue
+		}
+
+		for id, s := range h.streams[userID] {
+			if message.streamID != uuid.Nil && message.streamID != id {
+				continue
+			}
+			frame := s.push(message.message)
+			if client, ok := h.clients[userID][id]; ok && h.deliver(client, frame) {
+				delivered = append(delivered, userID)
 			}
-			h.mutex.RUnlock()
 		}
 	}
+
+	if message.message.Type == MessageTypeNewMessage && len(delivered) > 0 {
+		go h.recordDeliveries(message.message, delivered)
+	}
 }
 
-func (h *Hub) SendToUser(userID uuid.UUID, message []byte) {
-	h.mutex.RLock()
-	client, exists := h.clients[userID]
-	h.mutex.RUnlock()
-	
-	if exists {
-		select {
-		case client.Send <- message:
-		default:
-			close(client.Send)
-			h.mutex.Lock()
-			delete(h.clients, userID)
-			h.mutex.Unlock()
+// deliver queues a frame on the client's send buffer and drops the client
+// when the buffer is full; the device can resume and get the rest replayed.
+// It reports whether the frame was queued. The caller must hold h.mutex.
+func (h *Hub) deliver(client *Client, message []byte) bool {
+	select {
+	case client.Send <- message:
+		return true
+	default:
+		h.removeClient(client)
+		return false
+	}
+}
+
+// removeClient forgets the client, closes its send channel and leaves its
+// stream waiting for a resume. Removing a client that is already gone is a
+// no-op. The caller must hold h.mutex.
+func (h *Hub) removeClient(client *Client) {
+	devices, ok := h.clients[client.UserID]
+	if !ok {
+		return
+	}
+
+	if current, ok := devices[client.ID]; ok && current == client {
+		delete(devices, client.ID)
+		close(client.Send)
+
+		if s, ok := h.streams[client.UserID][client.ID]; ok {
+			s.detachedAt = time.Now()
 		}
 	}
+
+	if len(devices) == 0 {
+		delete(h.clients, client.UserID)
+	}
+}
+
+// CloseSessions tells the devices signed in with the given sessions of a user
+// that they were signed out and disconnects them, on every server instance
+func (h *Hub) CloseSessions(userID uuid.UUID, sessionIDs []uuid.UUID) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+
+	message := newEvent(MessageTypeSessionRevoked, userID, SessionRevokedPayload{SessionIDs: sessionIDs})
+	h.publish(&envelope{UserIDs: []uuid.UUID{userID}, Message: message, CloseSessions: sessionIDs})
+}
+
+// closeSessions delivers a session_revoked event to the matching devices and
+// drops them along with their streams, so they cannot resume
+func (h *Hub) closeSessions(e *envelope) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	data := e.Message.encode()
+	for _, userID := range e.UserIDs {
+		for _, client := range h.clients[userID] {
+			if !containsUser(e.CloseSessions, client.sessionID) {
+				continue
+			}
+
+			h.deliver(client, data)
+			h.removeClient(client)
+			delete(h.streams[userID], client.ID)
+		}
+	}
+}
+
+// SendToUser sends an event to every device of a single user
+func (h *Hub) SendToUser(userID uuid.UUID, message *Message) {
+	h.SendToUsers([]uuid.UUID{userID}, message)
+}
+
+// SendToUsers sends an event to every device of the listed users. Devices
+// that are reconnecting get it replayed when they resume.
+func (h *Hub) SendToUsers(userIDs []uuid.UUID, message *Message) {
+	if len(userIDs) == 0 {
+		return
+	}
+	h.publish(&envelope{UserIDs: userIDs, Message: message, Durable: true})
+}
+
+// sendEphemeral sends an event only to devices that are connected right now
+func (h *Hub) sendEphemeral(userIDs []uuid.UUID, message *Message) {
+	if len(userIDs) == 0 {
+		return
+	}
+	h.publish(&envelope{UserIDs: userIDs, Message: message})
+}
+
+// sendToClient sends an unsequenced reply to a single connection
+func (h *Hub) sendToClient(client *Client, message *Message) {
+	h.direct <- &directMessage{userIDs: []uuid.UUID{client.UserID}, streamID: client.ID, message: message}
+}
+
+// SendToChat sends an event to all active members of a chat
+func (h *Hub) SendToChat(chatID uuid.UUID, message *Message) error {
+	memberIDs, err := h.chatMemberIDs(chatID)
+	if err != nil {
+		return err
+	}
+	h.SendToUsers(memberIDs, message)
+	return nil
 }
 
 func (h *Hub) broadcastUserStatus(userID uuid.UUID, status models.UserStatus) {
@@ -136,14 +402,19 @@ func (h *Hub) broadcastUserStatus(userID uuid.UUID, status models.UserStatus) {
 		Type:      MessageTypeUserStatus,
 		UserID:    userID,
 		Timestamp: getCurrentTimestamp(),
-		Data: map[string]interface{}{
-			"user_id": userID,
-			"status":  status,
+		Data: UserStatusPayload{
+			UserID: userID,
+			Status: status,
 		},
 	}
 	
-	data, _ := json.Marshal(message)
-	h.broadcast <- data
+	// Users blocked by userID do not get to see their presence
+	blocked, err := h.blockedBy(userID)
+	if err != nil {
+		log.Printf("Failed to load users blocked by %s: %v", userID, err)
+	}
+
+	h.publish(&envelope{Message: &message, Broadcast: true, Except: blocked})
 }
 
 func (h *Hub) IsUserOnline(userID uuid.UUID) bool {
@@ -178,6 +449,25 @@ func (h *Hub) HandleWebSocket(authService *auth.Service) gin.HandlerFunc {
 			return
 		}
 
+		// Revoked sessions must not come back through a still valid access token
+		active, err := authService.SessionActive(claims.SessionID)
+		if err != nil || !active {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+			return
+		}
+
+		protocol, err := parseProtocolVersion(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		resume, err := parseResumeRequest(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			log.Printf("WebSocket upgrade error: %v", err)
@@ -190,7 +480,15 @@ func (h *Hub) HandleWebSocket(authService *auth.Service) gin.HandlerFunc {
 			Conn:   conn,
 			Send:   make(chan []byte, 256),
 			UserID: claims.UserID,
+			protocol: protocol,
+			resume:   resume,
+			sessionID: claims.SessionID,
+			auth:     authService,
 		}
+		if resume != nil {
+			client.ID = resume.streamID
+		}
+		client.authExpiry.Store(claims.ExpiresAt.Unix())
 
 		client.Hub.register <- client
 
@@ -199,6 +497,56 @@ func (h *Hub) HandleWebSocket(authService *auth.Service) gin.HandlerFunc {
 	}
 }
 
+// parseProtocolVersion negotiates the protocol version from the protocol
+// query parameter. Clients that do not send it get version 1; newer
+// versions than the server knows are downgraded to the latest one.
+func parseProtocolVersion(c *gin.Context) (int, error) {
+	versionStr := c.Query("protocol")
+	if versionStr == "" {
+		return ProtocolVersion1, nil
+	}
+
+	version, err := strconv.Atoi(versionStr)
+	if err != nil || version < ProtocolVersion1 {
+		return 0, errors.New("invalid protocol version")
+	}
+	if version > LatestProtocolVersion {
+		version = LatestProtocolVersion
+	}
+	return version, nil
+}
+
+// parseResumeRequest reads the optional stream_id, last_seq and since query
+// parameters a reconnecting client sends
+func parseResumeRequest(c *gin.Context) (*resumeRequest, error) {
+	streamIDStr := c.Query("stream_id")
+	if streamIDStr == "" {
+		return nil, nil
+	}
+
+	streamID, err := uuid.Parse(streamIDStr)
+	if err != nil {
+		return nil, errors.New("invalid stream_id")
+	}
+
+	lastSeq, err := strconv.ParseUint(c.DefaultQuery("last_seq", "0"), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid last_seq")
+	}
+
+	resume := &resumeRequest{streamID: streamID, lastSeq: lastSeq}
+	if sinceStr := c.Query("since"); sinceStr != "" {
+		since, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid since")
+		}
+		sinceTime := time.Unix(since, 0)
+		resume.since = &sinceTime
+	}
+
+	return resume, nil
+}
+
 func getCurrentTimestamp() int64 {
-	return 0 // Implement proper timestamp
+	return time.Now().Unix()
 }
\ No newline at end of file
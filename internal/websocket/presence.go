@@ -0,0 +1,39 @@
+package websocket
+
+import (
+	"log"
+	"messenger/pkg/models"
+	"time"
+	"github.com/google/uuid"
+)
+
+const (
+	// heartbeatInterval is how often a hub marks its connected users as
+	// present in the database
+	heartbeatInterval = 15 * time.Second
+
+	// PresenceTimeout is how long a user counts as connected after the last
+	// heartbeat. It covers brief reconnects and hubs that stopped without
+	// cleaning up.
+	PresenceTimeout = 3 * heartbeatInterval
+)
+
+// refreshPresence records that every user with a local connection is still
+// connected, so other server instances and background jobs can tell
+func (h *Hub) refreshPresence() {
+	h.mutex.RLock()
+	userIDs := make([]uuid.UUID, 0, len(h.clients))
+	for userID := range h.clients {
+		userIDs = append(userIDs, userID)
+	}
+	h.mutex.RUnlock()
+
+	if len(userIDs) == 0 {
+		return
+	}
+
+	err := h.db.Model(&models.User{}).Where("id IN ?", userIDs).Update("heartbeat_at", time.Now()).Error
+	if err != nil {
+		log.Printf("Failed to refresh presence: %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Protocol versions a client can request with the protocol query parameter
+// on /ws. Version 1 is the original untyped protocol: invalid frames are only
+// logged. Version 2 answers every rejected frame with an error frame and
+// confirms frames that carry an id.
+const (
+	ProtocolVersion1      = 1
+	ProtocolVersion2      = 2
+	LatestProtocolVersion = ProtocolVersion2
+)
+
+const maxContentLength = 4096
+
+// Error codes carried by error frames
+const (
+	ErrorCodeInvalidJSON    = "invalid_json"
+	ErrorCodeUnknownType    = "unknown_type"
+	ErrorCodeInvalidPayload = "invalid_payload"
+	ErrorCodeForbidden      = "forbidden"
+	ErrorCodeNotFound       = "not_found"
+	ErrorCodeInvalidState   = "invalid_state"
+	ErrorCodeUnauthorized   = "unauthorized"
+	ErrorCodeInternal       = "internal"
+)
+
+// ProtocolError is sent back to the client in an error frame
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newProtocolError(code, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// toProtocolError maps errors returned by handlers onto error frame codes
+func toProtocolError(err error) *ProtocolError {
+	var protocolErr *ProtocolError
+	switch {
+	case errors.As(err, &protocolErr):
+		return protocolErr
+	case errors.Is(err, errAccessDenied):
+		return newProtocolError(ErrorCodeForbidden, "access denied")
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return newProtocolError(ErrorCodeNotFound, "not found")
+	default:
+		return newProtocolError(ErrorCodeInternal, "internal error")
+	}
+}
+
+// inboundFrame is the envelope of every frame a client sends. ID is an
+// optional client-chosen correlation id echoed back in the reply.
+type inboundFrame struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Payload is implemented by every typed inbound event
+type Payload interface {
+	Validate() error
+}
+
+// ChatPayload is the data of a chat frame
+type ChatPayload struct {
+	ChatID      *uuid.UUID         `json:"chat_id,omitempty"`
+	ReceiverID  *uuid.UUID         `json:"receiver_id,omitempty"`
+	Content     string             `json:"content"`
+	MessageType models.MessageType `json:"message_type,omitempty"`
+}
+
+func (p *ChatPayload) Validate() error {
+	if err := validateConversation(p.ChatID, p.ReceiverID); err != nil {
+		return err
+	}
+	if p.Content == "" {
+		return invalidPayload("content is required")
+	}
+	if len(p.Content) > maxContentLength {
+		return invalidPayload(fmt.Sprintf("content exceeds %d bytes", maxContentLength))
+	}
+	switch p.MessageType {
+	case "", models.MessageTypeText, models.MessageTypeFile, models.MessageTypeImage,
+		models.MessageTypeVideo, models.MessageTypeAudio:
+		return nil
+	}
+	return invalidPayload("unsupported message_type")
+}
+
+// TypingPayload is the data of a typing frame
+type TypingPayload struct {
+	ChatID     *uuid.UUID `json:"chat_id,omitempty"`
+	ReceiverID *uuid.UUID `json:"receiver_id,omitempty"`
+	IsTyping   bool       `json:"is_typing"`
+}
+
+func (p *TypingPayload) Validate() error {
+	return validateConversation(p.ChatID, p.ReceiverID)
+}
+
+// CallSignalPayload is the data of call_offer, call_answer, ice_candidate,
+// call_renegotiate, call_reject and call_end frames. CallID refers to a call
+// created through the API; TargetUserID addresses one participant and
+// defaults to all the others. A renegotiation carries either a new offer or
+// the answer to one.
+type CallSignalPayload struct {
+	CallID       uuid.UUID       `json:"call_id"`
+	TargetUserID *uuid.UUID      `json:"target_user_id,omitempty"`
+	Offer        json.RawMessage `json:"offer,omitempty"`
+	Answer       json.RawMessage `json:"answer,omitempty"`
+	Candidate    json.RawMessage `json:"candidate,omitempty"`
+
+	kind string
+}
+
+func (p *CallSignalPayload) Validate() error {
+	if p.CallID == uuid.Nil {
+		return invalidPayload("call_id is required")
+	}
+	switch p.kind {
+	case MessageTypeCallOffer:
+		if len(p.Offer) == 0 {
+			return invalidPayload("offer is required")
+		}
+	case MessageTypeCallAnswer:
+		if len(p.Answer) == 0 {
+			return invalidPayload("answer is required")
+		}
+	case MessageTypeICECandidate:
+		if len(p.Candidate) == 0 {
+			return invalidPayload("candidate is required")
+		}
+	case MessageTypeCallRenegotiate:
+		if (len(p.Offer) == 0) == (len(p.Answer) == 0) {
+			return invalidPayload("exactly one of offer or answer is required")
+		}
+	}
+	return nil
+}
+
+// MessageReadPayload is the data of a message_read frame
+type MessageReadPayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+func (p *MessageReadPayload) Validate() error {
+	if p.MessageID == uuid.Nil {
+		return invalidPayload("message_id is required")
+	}
+	return nil
+}
+
+// AckPayload is the data of an ack frame
+type AckPayload struct {
+	Seq uint64 `json:"seq"`
+}
+
+func (p *AckPayload) Validate() error {
+	if p.Seq == 0 {
+		return invalidPayload("seq is required")
+	}
+	return nil
+}
+
+// AuthPayload is the data of an auth frame. It carries a fresh access token
+// so the connection outlives the one it was opened with.
+type AuthPayload struct {
+	Token string `json:"token"`
+}
+
+func (p *AuthPayload) Validate() error {
+	if p.Token == "" {
+		return invalidPayload("token is required")
+	}
+	return nil
+}
+
+// UserStatusPayload is the data of a user_status event
+type UserStatusPayload struct {
+	UserID uuid.UUID         `json:"user_id"`
+	Status models.UserStatus `json:"status"`
+}
+
+// SessionRevokedPayload is the data of a session_revoked event, sent right
+// before the server closes the connection
+type SessionRevokedPayload struct {
+	SessionIDs []uuid.UUID `json:"session_ids"`
+}
+
+// MessageDeletedPayload is the data of a message_deleted event
+type MessageDeletedPayload struct {
+	ID         uuid.UUID  `json:"id"`
+	ChatID     *uuid.UUID `json:"chat_id"`
+	ReceiverID *uuid.UUID `json:"receiver_id"`
+}
+
+// ResultPayload confirms a frame that carried a correlation id
+type ResultPayload struct {
+	Type string `json:"type"`
+}
+
+// decodePayload parses and validates the data of an inbound frame
+func decodePayload(frame *inboundFrame) (Payload, error) {
+	var payload Payload
+	switch frame.Type {
+	case MessageTypeChat:
+		payload = &ChatPayload{}
+	case MessageTypeTyping:
+		payload = &TypingPayload{}
+	case MessageTypeCallOffer, MessageTypeCallAnswer, MessageTypeCallReject, MessageTypeCallEnd,
+		MessageTypeICECandidate, MessageTypeCallRenegotiate:
+		payload = &CallSignalPayload{kind: frame.Type}
+	case MessageTypeMessageRead:
+		payload = &MessageReadPayload{}
+	case MessageTypeAck:
+		payload = &AckPayload{}
+	case MessageTypeAuth:
+		payload = &AuthPayload{}
+	default:
+		return nil, newProtocolError(ErrorCodeUnknownType, fmt.Sprintf("unknown message type %q", frame.Type))
+	}
+
+	if len(frame.Data) == 0 {
+		return nil, invalidPayload("data is required")
+	}
+	if err := json.Unmarshal(frame.Data, payload); err != nil {
+		return nil, invalidPayload(err.Error())
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func validateConversation(chatID, receiverID *uuid.UUID) error {
+	if (chatID == nil) == (receiverID == nil) {
+		return invalidPayload("exactly one of chat_id or receiver_id is required")
+	}
+	return nil
+}
+
+func invalidPayload(message string) *ProtocolError {
+	return newProtocolError(ErrorCodeInvalidPayload, message)
+}
@@ -0,0 +1,38 @@
+package websocket
+
+import (
+	"github.com/google/uuid"
+)
+
+// Publisher pushes server-side events to connected clients. It is
+// implemented by Hub and handed to HTTP handlers so REST actions show up
+// in real time.
+type Publisher interface {
+	PublishToUsers(userIDs []uuid.UUID, eventType string, actorID uuid.UUID, data interface{})
+	PublishToChat(chatID uuid.UUID, eventType string, actorID uuid.UUID, data interface{}) error
+}
+
+// SessionCloser disconnects the devices of sessions that were revoked. It is
+// implemented by Hub.
+type SessionCloser interface {
+	CloseSessions(userID uuid.UUID, sessionIDs []uuid.UUID)
+}
+
+// PublishToUsers sends an event to every device of the listed users
+func (h *Hub) PublishToUsers(userIDs []uuid.UUID, eventType string, actorID uuid.UUID, data interface{}) {
+	h.SendToUsers(userIDs, newEvent(eventType, actorID, data))
+}
+
+// PublishToChat sends an event to all active members of a chat
+func (h *Hub) PublishToChat(chatID uuid.UUID, eventType string, actorID uuid.UUID, data interface{}) error {
+	return h.SendToChat(chatID, newEvent(eventType, actorID, data))
+}
+
+func newEvent(eventType string, actorID uuid.UUID, data interface{}) *Message {
+	return &Message{
+		Type:      eventType,
+		Data:      data,
+		UserID:    actorID,
+		Timestamp: getCurrentTimestamp(),
+	}
+}
@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"log"
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+)
+
+// ReceiptTracker records per-recipient delivery and read receipts. The hub
+// reports deliveries on its own; reads come from message_read frames.
+type ReceiptTracker interface {
+	MarkDelivered(messageID, userID uuid.UUID) error
+	MarkRead(messageID, userID uuid.UUID) error
+}
+
+// recordDeliveries reports a new_message event handed to the devices of
+// userIDs. It runs outside the Run loop because it hits the database.
+func (h *Hub) recordDeliveries(message *Message, userIDs []uuid.UUID) {
+	if h.receipts == nil {
+		return
+	}
+
+	messageID, ok := eventMessageID(message.Data)
+	if !ok {
+		return
+	}
+
+	seen := make(map[uuid.UUID]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] || userID == message.UserID {
+			continue
+		}
+		seen[userID] = true
+
+		if err := h.receipts.MarkDelivered(messageID, userID); err != nil {
+			log.Printf("Failed to record delivery of %s to %s: %v", messageID, userID, err)
+		}
+	}
+}
+
+// eventMessageID extracts the id of the stored message carried by an event.
+// Events that went through the broker carry decoded JSON instead of the
+// model.
+func eventMessageID(data interface{}) (uuid.UUID, bool) {
+	switch v := data.(type) {
+	case models.Message:
+		return v.ID, true
+	case *models.Message:
+		return v.ID, true
+	case map[string]interface{}:
+		if raw, ok := v["id"].(string); ok {
+			id, err := uuid.Parse(raw)
+			return id, err == nil
+		}
+	}
+	return uuid.Nil, false
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+	"github.com/google/uuid"
+)
+
+// Delays between attempts to subscribe to the broker
+const (
+	subscribeMinDelay = time.Second
+	subscribeMaxDelay = 30 * time.Second
+)
+
+// envelope is how an event travels through the broker between hubs
+type envelope struct {
+	UserIDs   []uuid.UUID `json:"user_ids,omitempty"`
+	Broadcast bool        `json:"broadcast,omitempty"`
+	// Except lists users a broadcast must not reach
+	Except    []uuid.UUID `json:"except,omitempty"`
+	Durable   bool        `json:"durable,omitempty"`
+	// CloseSessions disconnects the devices of UserIDs signed in with one
+	// of these sessions after delivering Message
+	CloseSessions []uuid.UUID `json:"close_sessions,omitempty"`
+	Message   *Message    `json:"message"`
+}
+
+// publish hands an event to the broker. Every hub, this one included,
+// picks it up in receive and delivers it to its own connections.
+func (h *Hub) publish(e *envelope) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", e.Message.Type, err)
+		return
+	}
+
+	if err := h.broker.Publish(context.Background(), payload); err != nil {
+		log.Printf("Failed to publish %s event: %v", e.Message.Type, err)
+	}
+}
+
+// receive queues an event coming from the broker for the Run loop. It never
+// blocks, so the Run loop itself may publish without deadlocking.
+func (h *Hub) receive(payload []byte) {
+	var e envelope
+	if err := json.Unmarshal(payload, &e); err != nil || e.Message == nil {
+		log.Printf("Dropping malformed broker event: %v", err)
+		return
+	}
+
+	h.inboxMutex.Lock()
+	h.inbox = append(h.inbox, &e)
+	h.inboxMutex.Unlock()
+
+	select {
+	case h.inboxReady <- struct{}{}:
+	default:
+	}
+}
+
+// drainInbox delivers every queued broker event to local connections
+func (h *Hub) drainInbox() {
+	h.inboxMutex.Lock()
+	events := h.inbox
+	h.inbox = nil
+	h.inboxMutex.Unlock()
+
+	for _, e := range events {
+		if len(e.CloseSessions) > 0 {
+			h.closeSessions(e)
+			continue
+		}
+		if e.Broadcast {
+			h.deliverAll(e.Message.encode(), e.Except)
+			continue
+		}
+		h.deliverTo(&directMessage{userIDs: e.UserIDs, message: e.Message, durable: e.Durable})
+	}
+}
@@ -0,0 +1,138 @@
+package websocket
+
+import (
+	"encoding/json"
+	"messenger/internal/broker"
+	"testing"
+	"github.com/google/uuid"
+)
+
+// connect attaches a fake device of userID to the hub and drops the session
+// frame every new connection gets
+func connect(t *testing.T, h *Hub, userID uuid.UUID) *Client {
+	t.Helper()
+
+	client := &Client{ID: uuid.New(), Hub: h, Send: make(chan []byte, 16), UserID: userID}
+	h.mutex.Lock()
+	h.attachStream(client)
+	h.mutex.Unlock()
+
+	frame := receiveFrame(t, client)
+	if frame.Type != MessageTypeSession {
+		t.Fatalf("first frame is %q, want session", frame.Type)
+	}
+	return client
+}
+
+func receiveFrame(t *testing.T, client *Client) *Message {
+	t.Helper()
+
+	select {
+	case data := <-client.Send:
+		var message Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatalf("decode frame: %v", err)
+		}
+		return &message
+	default:
+		t.Fatal("no frame was delivered")
+		return nil
+	}
+}
+
+func expectNoFrame(t *testing.T, client *Client) {
+	t.Helper()
+
+	select {
+	case data := <-client.Send:
+		t.Fatalf("unexpected frame %s", data)
+	default:
+	}
+}
+
+// newHubs starts n hubs that share one in-memory broker, like server
+// instances sharing Redis. The Run loops are not started; tests drain the
+// inboxes themselves.
+func newHubs(t *testing.T, n int) []*Hub {
+	t.Helper()
+
+	b := broker.NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+
+	hubs := make([]*Hub, n)
+	for i := range hubs {
+		hubs[i] = NewHub(nil, b)
+		hubs[i].subscribe()
+	}
+	return hubs
+}
+
+func TestEventPublishedOnOneHubReachesUserOnAnother(t *testing.T) {
+	hubs := newHubs(t, 2)
+	hubA, hubB := hubs[0], hubs[1]
+
+	userID := uuid.New()
+	client := connect(t, hubA, userID)
+
+	hubB.SendToUser(userID, newEvent(MessageTypeNewMessage, uuid.New(), map[string]string{"content": "hello"}))
+
+	// hubB has no connection for the user and delivers nothing
+	hubB.drainInbox()
+	hubA.drainInbox()
+
+	frame := receiveFrame(t, client)
+	if frame.Type != MessageTypeNewMessage {
+		t.Fatalf("got %q, want %q", frame.Type, MessageTypeNewMessage)
+	}
+	if frame.Seq != 1 {
+		t.Fatalf("durable event has seq %d, want 1", frame.Seq)
+	}
+	data, _ := frame.Data.(map[string]interface{})
+	if data["content"] != "hello" {
+		t.Fatalf("got data %v", frame.Data)
+	}
+}
+
+func TestEventReachesEveryDeviceOnEveryHub(t *testing.T) {
+	hubs := newHubs(t, 2)
+
+	userID := uuid.New()
+	phone := connect(t, hubs[0], userID)
+	laptop := connect(t, hubs[1], userID)
+	other := connect(t, hubs[1], uuid.New())
+
+	hubs[0].sendEphemeral([]uuid.UUID{userID}, newEvent(MessageTypeTyping, uuid.New(), nil))
+	for _, h := range hubs {
+		h.drainInbox()
+	}
+
+	for _, client := range []*Client{phone, laptop} {
+		frame := receiveFrame(t, client)
+		if frame.Type != MessageTypeTyping || frame.Seq != 0 {
+			t.Fatalf("got %q with seq %d, want unsequenced typing", frame.Type, frame.Seq)
+		}
+	}
+	expectNoFrame(t, other)
+}
+
+func TestBroadcastSkipsExcludedUsersOnEveryHub(t *testing.T) {
+	hubs := newHubs(t, 2)
+
+	blocked := uuid.New()
+	excluded := connect(t, hubs[0], blocked)
+	included := connect(t, hubs[1], uuid.New())
+
+	hubs[1].publish(&envelope{
+		Broadcast: true,
+		Except:    []uuid.UUID{blocked},
+		Message:   newEvent(MessageTypeUserStatus, uuid.New(), nil),
+	})
+	for _, h := range hubs {
+		h.drainInbox()
+	}
+
+	if frame := receiveFrame(t, included); frame.Type != MessageTypeUserStatus {
+		t.Fatalf("got %q, want %q", frame.Type, MessageTypeUserStatus)
+	}
+	expectNoFrame(t, excluded)
+}
@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"messenger/pkg/models"
+	"github.com/google/uuid"
+)
+
+// CallRegistry gives the hub access to persisted calls so signaling frames
+// only reach the people in a call. It is implemented by the call service.
+type CallRegistry interface {
+	// LiveParticipants returns the users taking part in a call that has
+	// not finished yet, or nothing when the call is over or unknown
+	LiveParticipants(callID uuid.UUID) ([]uuid.UUID, error)
+	Reject(callID, userID uuid.UUID) (*models.Call, error)
+	End(callID, userID uuid.UUID) (*models.Call, error)
+}
+
+// SetCallRegistry installs the registry used to route call signaling. It
+// must be called before Run.
+func (h *Hub) SetCallRegistry(registry CallRegistry) {
+	h.calls = registry
+}
+
+// callPeers returns who a signaling frame from userID should reach: the
+// target participant when one is given, otherwise everybody else in the call
+func (h *Hub) callPeers(userID uuid.UUID, payload *CallSignalPayload) ([]uuid.UUID, error) {
+	if h.calls == nil {
+		return nil, newProtocolError(ErrorCodeInternal, "calls are not available")
+	}
+
+	participants, err := h.calls.LiveParticipants(payload.CallID)
+	if err != nil {
+		return nil, err
+	}
+	if !containsUser(participants, userID) {
+		return nil, newProtocolError(ErrorCodeForbidden, "not a participant of an ongoing call")
+	}
+
+	if payload.TargetUserID != nil {
+		if *payload.TargetUserID == userID || !containsUser(participants, *payload.TargetUserID) {
+			return nil, invalidPayload("target_user_id is not a participant of this call")
+		}
+		return []uuid.UUID{*payload.TargetUserID}, nil
+	}
+	return withoutUser(participants, userID), nil
+}
@@ -0,0 +1,234 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"messenger/pkg/models"
+	"time"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxPendingEvents bounds how many unacknowledged events a stream keeps
+	// around for replay
+	maxPendingEvents = 200
+
+	// resumeWindow is how long a stream survives without a connection
+	// before a reconnecting device has to start over
+	resumeWindow = 2 * time.Minute
+
+	// maxReplayMessages bounds how many stored messages are replayed when
+	// the in-memory buffer cannot cover the gap
+	maxReplayMessages = 200
+)
+
+// Resume modes reported to the client in the session frame
+const (
+	ResumeModeNone     = "none"
+	ResumeModeBuffer   = "buffer"
+	ResumeModeDatabase = "database"
+	ResumeModeReset    = "reset"
+)
+
+type sequencedFrame struct {
+	seq  uint64
+	data []byte
+}
+
+// stream is the ordered event feed of a single device session. It outlives
+// the WebSocket connection so a device that reconnects can pick up from the
+// last sequence number it has seen.
+type stream struct {
+	id         uuid.UUID
+	userID     uuid.UUID
+	lastSeq    uint64
+	pending    []sequencedFrame
+	detachedAt time.Time
+}
+
+// resumeRequest is what a reconnecting client sends on /ws
+type resumeRequest struct {
+	streamID uuid.UUID
+	lastSeq  uint64
+	since    *time.Time
+}
+
+// SessionInfo is the payload of the session frame sent right after connect
+type SessionInfo struct {
+	Protocol int       `json:"protocol"`
+	StreamID uuid.UUID `json:"stream_id"`
+	LastSeq  uint64    `json:"last_seq"`
+	Resume   string    `json:"resume"`
+	Replayed int       `json:"replayed"`
+}
+
+// push stamps the next sequence number on the event and keeps the encoded
+// frame until the client acknowledges it
+func (s *stream) push(message *Message) []byte {
+	s.lastSeq++
+
+	event := *message
+	event.Seq = s.lastSeq
+	data, _ := json.Marshal(event)
+
+	s.pending = append(s.pending, sequencedFrame{seq: s.lastSeq, data: data})
+	if len(s.pending) > maxPendingEvents {
+		s.pending = s.pending[len(s.pending)-maxPendingEvents:]
+	}
+
+	return data
+}
+
+// ack drops every pending frame up to and including seq
+func (s *stream) ack(seq uint64) {
+	i := 0
+	for i < len(s.pending) && s.pending[i].seq <= seq {
+		i++
+	}
+	s.pending = s.pending[i:]
+}
+
+// after returns the frames following seq. The second result is false when
+// some of them are no longer buffered.
+func (s *stream) after(seq uint64) ([][]byte, bool) {
+	if seq > s.lastSeq {
+		return nil, false
+	}
+	if seq == s.lastSeq {
+		return nil, true
+	}
+	if len(s.pending) == 0 || s.pending[0].seq > seq+1 {
+		return nil, false
+	}
+
+	frames := make([][]byte, 0, s.lastSeq-seq)
+	for _, frame := range s.pending {
+		if frame.seq > seq {
+			frames = append(frames, frame.data)
+		}
+	}
+	return frames, true
+}
+
+// attachStream binds the client to its stream, resuming the requested one if
+// it is still buffered, and queues the session frame plus any replayed
+// events. It reports whether this is the user's first device and, when the
+// buffer could not cover the gap, the time to replay stored messages from.
+// The caller must hold h.mutex.
+func (h *Hub) attachStream(client *Client) (bool, *time.Time) {
+	streams, ok := h.streams[client.UserID]
+	if !ok {
+		streams = make(map[uuid.UUID]*stream)
+		h.streams[client.UserID] = streams
+	}
+
+	info := SessionInfo{Protocol: client.protocol, StreamID: client.ID, Resume: ResumeModeNone}
+	var frames [][]byte
+	var replaySince *time.Time
+
+	s, found := streams[client.ID]
+	if client.resume != nil {
+		if found {
+			frames, found = s.after(client.resume.lastSeq)
+		}
+		if found {
+			info.Resume = ResumeModeBuffer
+			info.Replayed = len(frames)
+		} else if client.resume.since != nil {
+			info.Resume = ResumeModeDatabase
+			replaySince = client.resume.since
+		} else {
+			info.Resume = ResumeModeReset
+		}
+	}
+	if s == nil {
+		s = &stream{id: client.ID, userID: client.UserID}
+		streams[client.ID] = s
+	}
+	info.LastSeq = s.lastSeq
+
+	if previous, ok := h.clients[client.UserID][client.ID]; ok {
+		// The device reconnected before the old socket timed out
+		h.removeClient(previous)
+	}
+	devices, ok := h.clients[client.UserID]
+	if !ok {
+		devices = make(map[uuid.UUID]*Client)
+		h.clients[client.UserID] = devices
+	}
+	devices[client.ID] = client
+	s.detachedAt = time.Time{}
+
+	h.deliver(client, newEvent(MessageTypeSession, client.UserID, info).encode())
+	for _, frame := range frames {
+		h.deliver(client, frame)
+	}
+
+	return len(devices) == 1, replaySince
+}
+
+// acknowledge records that the client has processed every event up to seq
+func (h *Hub) acknowledge(client *Client, seq uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if s, ok := h.streams[client.UserID][client.ID]; ok {
+		s.ack(seq)
+	}
+}
+
+// expireStreams forgets streams whose device has not come back within the
+// resume window
+func (h *Hub) expireStreams() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	cutoff := time.Now().Add(-resumeWindow)
+	for userID, streams := range h.streams {
+		for id, s := range streams {
+			if _, attached := h.clients[userID][id]; attached {
+				continue
+			}
+			if s.detachedAt.Before(cutoff) {
+				delete(streams, id)
+			}
+		}
+		if len(streams) == 0 {
+			delete(h.streams, userID)
+		}
+	}
+}
+
+// replayFromDatabase re-sends messages stored after since to a single
+// stream. It is used when the in-memory buffer no longer covers the gap.
+func (h *Hub) replayFromDatabase(client *Client, since time.Time) {
+	memberChats := h.db.Model(&models.ChatMember{}).
+		Select("chat_id").
+		Where("user_id = ? AND is_active = ?", client.UserID, true)
+
+	var messages []models.Message
+	err := h.db.Preload("Sender").
+		Preload("Receiver").
+		Preload("Chat").
+		Preload("ReplyTo").
+		Preload("Files").
+		Where("created_at > ?", since).
+		Where("chat_id IN (?) OR receiver_id = ? OR (sender_id = ? AND receiver_id IS NOT NULL)",
+			memberChats, client.UserID, client.UserID).
+		Order("created_at ASC").
+		Limit(maxReplayMessages).
+		Find(&messages).Error
+	if err != nil {
+		log.Printf("Failed to replay messages for %s: %v", client.UserID, err)
+		return
+	}
+
+	for i := range messages {
+		h.direct <- &directMessage{
+			userIDs:  []uuid.UUID{client.UserID},
+			streamID: client.ID,
+			message:  newEvent(MessageTypeNewMessage, messages[i].SenderID, messages[i]),
+			durable:  true,
+		}
+	}
+}
@@ -28,8 +28,9 @@ const (
 type Call struct {
 	ID           uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	CallerID     uuid.UUID  `json:"caller_id" gorm:"type:uuid;not null"`
-	CalleeID     uuid.UUID  `json:"callee_id" gorm:"type:uuid;not null"`
-	ChatID       *uuid.UUID `json:"chat_id" gorm:"type:uuid"`
+	// CalleeID is empty for group calls, whose members are Participants
+	CalleeID     *uuid.UUID `json:"callee_id" gorm:"type:uuid"`
+	ChatID       *uuid.UUID `json:"chat_id" gorm:"type:uuid;index"`
 	Type         CallType   `json:"type" gorm:"default:'voice'"`
 	Status       CallStatus `json:"status" gorm:"default:'initiated'"`
 	StartTime    time.Time  `json:"start_time"`
@@ -42,15 +43,15 @@ type Call struct {
 
 	// Relationships
 	Caller      User            `json:"caller" gorm:"foreignKey:CallerID"`
-	Callee      User            `json:"callee" gorm:"foreignKey:CalleeID"`
+	Callee      *User           `json:"callee" gorm:"foreignKey:CalleeID"`
 	Chat        *Chat           `json:"chat" gorm:"foreignKey:ChatID"`
 	Participants []CallParticipant `json:"participants" gorm:"foreignKey:CallID"`
 }
 
 type CallParticipant struct {
 	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	CallID    uuid.UUID  `json:"call_id" gorm:"type:uuid;not null"`
-	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null"`
+	CallID    uuid.UUID  `json:"call_id" gorm:"type:uuid;not null;uniqueIndex:idx_call_participants_call_user"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_call_participants_call_user"`
 	JoinedAt  time.Time  `json:"joined_at"`
 	LeftAt    *time.Time `json:"left_at"`
 	IsMuted   bool       `json:"is_muted" gorm:"default:false"`
@@ -59,13 +60,13 @@ type CallParticipant struct {
 	UpdatedAt time.Time  `json:"updated_at"`
 
 	// Relationships
-	Call Call `json:"call" gorm:"foreignKey:CallID"`
-	User User `json:"user" gorm:"foreignKey:UserID"`
+	Call *Call `json:"call,omitempty" gorm:"foreignKey:CallID"`
+	User User  `json:"user" gorm:"foreignKey:UserID"`
 }
 
 type CallSettings struct {
 	ID                uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	UserID            uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
+	UserID            uuid.UUID `json:"user_id" gorm:"type:uuid;not null;uniqueIndex"`
 	AllowVoiceCalls   bool      `json:"allow_voice_calls" gorm:"default:true"`
 	AllowVideoCalls   bool      `json:"allow_video_calls" gorm:"default:true"`
 	AllowScreenShare  bool      `json:"allow_screen_share" gorm:"default:true"`
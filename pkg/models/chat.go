@@ -22,6 +22,8 @@ type Chat struct {
 	Avatar      string    `json:"avatar"`
 	CreatedBy   uuid.UUID `json:"created_by" gorm:"type:uuid;not null"`
 	IsActive    bool      `json:"is_active" gorm:"default:true"`
+	// StorageQuota overrides FileConfig.ChatQuota (bytes, 0 = unlimited)
+	StorageQuota *int64 `json:"-"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
@@ -48,6 +50,9 @@ type ChatMember struct {
 	IsActive  bool           `json:"is_active" gorm:"default:true"`
 	JoinedAt  time.Time      `json:"joined_at"`
 	LeftAt    *time.Time     `json:"left_at"`
+	// Read cursor: everything up to LastReadAt counts as read
+	LastReadMessageID *uuid.UUID `json:"last_read_message_id" gorm:"type:uuid"`
+	LastReadAt        *time.Time `json:"last_read_at"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 
@@ -29,14 +29,14 @@ const (
 type Message struct {
 	ID         uuid.UUID     `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	SenderID   uuid.UUID     `json:"sender_id" gorm:"type:uuid;not null"`
-	ReceiverID *uuid.UUID    `json:"receiver_id" gorm:"type:uuid"`
-	ChatID     *uuid.UUID    `json:"chat_id" gorm:"type:uuid"`
+	ReceiverID *uuid.UUID    `json:"receiver_id" gorm:"type:uuid;index:idx_messages_receiver_created,priority:1"`
+	ChatID     *uuid.UUID    `json:"chat_id" gorm:"type:uuid;index:idx_messages_chat_created,priority:1"`
 	Content    string        `json:"content"`
 	Type       MessageType   `json:"type" gorm:"default:'text'"`
 	Status     MessageStatus `json:"status" gorm:"default:'sent'"`
 	IsEdited   bool          `json:"is_edited" gorm:"default:false"`
 	ReplyToID  *uuid.UUID    `json:"reply_to_id" gorm:"type:uuid"`
-	CreatedAt  time.Time     `json:"created_at"`
+	CreatedAt  time.Time     `json:"created_at" gorm:"index:idx_messages_chat_created,priority:2;index:idx_messages_receiver_created,priority:2"`
 	UpdatedAt  time.Time     `json:"updated_at"`
 	DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
 
@@ -50,6 +50,27 @@ type Message struct {
 	Reactions []Reaction `json:"reactions" gorm:"foreignKey:MessageID"`
 }
 
+// FileProcessingStatus tracks thumbnail and metadata extraction for a file
+type FileProcessingStatus string
+
+const (
+	FileProcessingPending FileProcessingStatus = "pending"
+	FileProcessingReady   FileProcessingStatus = "ready"
+	FileProcessingFailed  FileProcessingStatus = "failed"
+	// FileProcessingSkipped is used for files that are not media
+	FileProcessingSkipped FileProcessingStatus = "skipped"
+)
+
+// Thumbnail is a downscaled preview of an image, or the poster frame of a
+// video. It is served by GET /files/:id?thumb=<name>.
+type Thumbnail struct {
+	Name     string `json:"name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	MimeType string `json:"mime_type"`
+	Path     string `json:"-"`
+}
+
 type File struct {
 	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	MessageID uuid.UUID `json:"message_id" gorm:"type:uuid;not null"`
@@ -57,9 +78,20 @@ type File struct {
 	FileSize  int64     `json:"file_size"`
 	MimeType  string    `json:"mime_type"`
 	FilePath  string    `json:"file_path"`
+	// ContentHash is the hex SHA-256 of the content; files with the same
+	// hash share one stored object and count once towards a quota
+	ContentHash string  `json:"content_hash" gorm:"index"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
+	// Media metadata, filled in in the background after upload
+	ProcessingStatus FileProcessingStatus `json:"processing_status" gorm:"default:'pending';index"`
+	Width            int                  `json:"width,omitempty"`
+	Height           int                  `json:"height,omitempty"`
+	Duration         float64              `json:"duration,omitempty"` // seconds
+	BlurHash         string               `json:"blurhash,omitempty"`
+	Thumbnails       []Thumbnail          `json:"thumbnails,omitempty" gorm:"serializer:json"`
+
 	// Relationships
 	Message Message `json:"message" gorm:"foreignKey:MessageID"`
 }
@@ -79,8 +111,8 @@ type Reaction struct {
 
 type MessageRead struct {
 	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	MessageID uuid.UUID `json:"message_id" gorm:"type:uuid;not null"`
-	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
+	MessageID uuid.UUID `json:"message_id" gorm:"type:uuid;not null;uniqueIndex:idx_message_reads_message_user"`
+	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_message_reads_message_user"`
 	ReadAt    time.Time `json:"read_at"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -88,4 +120,56 @@ type MessageRead struct {
 	// Relationships
 	Message Message `json:"message" gorm:"foreignKey:MessageID"`
 	User    User    `json:"user" gorm:"foreignKey:UserID"`
-}
\ No newline at end of file
+}
+
+// MessageDelivery records that a message reached at least one device of a recipient
+type MessageDelivery struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	MessageID   uuid.UUID `json:"message_id" gorm:"type:uuid;not null;uniqueIndex:idx_message_deliveries_message_user"`
+	UserID      uuid.UUID `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_message_deliveries_message_user"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Relationships
+	Message Message `json:"message" gorm:"foreignKey:MessageID"`
+	User    User    `json:"user" gorm:"foreignKey:UserID"`
+}
+
+// DirectReadCursor is how far a user has read the direct conversation with
+// PeerID; chats keep the same cursor on ChatMember
+type DirectReadCursor struct {
+	ID                uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID            uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_direct_read_cursors_user_peer"`
+	PeerID            uuid.UUID  `json:"peer_id" gorm:"type:uuid;not null;uniqueIndex:idx_direct_read_cursors_user_peer"`
+	LastReadMessageID *uuid.UUID `json:"last_read_message_id" gorm:"type:uuid"`
+	LastReadAt        *time.Time `json:"last_read_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+type UploadSessionStatus string
+
+const (
+	UploadSessionPending   UploadSessionStatus = "pending"
+	UploadSessionCompleted UploadSessionStatus = "completed"
+)
+
+// UploadSession is a resumable upload in progress. The file is attached to
+// MessageID, or to a new message in ChatID / for ReceiverID, once complete.
+type UploadSession struct {
+	ID            uuid.UUID           `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID        uuid.UUID           `json:"user_id" gorm:"type:uuid;not null;index"`
+	FileName      string              `json:"file_name"`
+	FileSize      int64               `json:"file_size"`
+	BytesReceived int64               `json:"offset" gorm:"default:0"`
+	Checksum      string              `json:"checksum"` // hex SHA-256 of the whole file, optional
+	MessageID     *uuid.UUID          `json:"message_id" gorm:"type:uuid"`
+	ChatID        *uuid.UUID          `json:"chat_id" gorm:"type:uuid"`
+	ReceiverID    *uuid.UUID          `json:"receiver_id" gorm:"type:uuid"`
+	Content       string              `json:"content"`
+	Status        UploadSessionStatus `json:"status" gorm:"default:'pending'"`
+	ExpiresAt     time.Time           `json:"expires_at" gorm:"index"`
+	CreatedAt     time.Time           `json:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at"`
+}
@@ -20,13 +20,20 @@ type User struct {
 	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	Username  string     `json:"username" gorm:"uniqueIndex;not null"`
 	Email     string     `json:"email" gorm:"uniqueIndex;not null"`
+	// EmailVerifiedAt is when the current email was confirmed, nil until then
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 	Password  string     `json:"-" gorm:"not null"`
 	FirstName string     `json:"first_name"`
 	LastName  string     `json:"last_name"`
 	Avatar    string     `json:"avatar"`
 	Status    UserStatus `json:"status" gorm:"default:'offline'"`
 	LastSeen  *time.Time `json:"last_seen"`
+	// HeartbeatAt is refreshed by the WebSocket hubs while the user has a
+	// device connected to any server instance
+	HeartbeatAt *time.Time `json:"-" gorm:"index"`
 	IsActive  bool       `json:"is_active" gorm:"default:true"`
+	// StorageQuota overrides FileConfig.UserQuota (bytes, 0 = unlimited)
+	StorageQuota *int64 `json:"-"`
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
@@ -40,12 +47,50 @@ type User struct {
 	ReceivedCalls    []Call `json:"-" gorm:"foreignKey:CalleeID"`
 }
 
+type TokenPurpose string
+
+const (
+	TokenPurposeVerifyEmail   TokenPurpose = "verify_email"
+	TokenPurposeResetPassword TokenPurpose = "reset_password"
+)
+
+// UserToken is a single-use token sent to a user by email. Email is the
+// address it was sent to, so a token stops working once the address changes.
+type UserToken struct {
+	ID        uuid.UUID    `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID    uuid.UUID    `json:"user_id" gorm:"type:uuid;not null;index"`
+	Purpose   TokenPurpose `json:"purpose" gorm:"not null"`
+	// Token is the SHA-256 of the token, never the token itself
+	Token     string     `json:"-" gorm:"not null;uniqueIndex"`
+	Email     string     `json:"email"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Relationships
+	User User `json:"user" gorm:"foreignKey:UserID"`
+}
+
+type ContactStatus string
+
+const (
+	// ContactStatusPending is a request from UserID waiting for ContactID
+	ContactStatusPending  ContactStatus = "pending"
+	ContactStatusAccepted ContactStatus = "accepted"
+	ContactStatusDeclined ContactStatus = "declined"
+	// ContactStatusNone marks a row that only records a block
+	ContactStatusNone     ContactStatus = "none"
+)
+
+// Contact is one side of a relationship: the row owned by UserID holds its
+// nickname for ContactID and whether UserID blocked them
 type Contact struct {
-	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
-	ContactID uuid.UUID `json:"contact_id" gorm:"type:uuid;not null"`
-	Nickname  string    `json:"nickname"`
-	IsBlocked bool      `json:"is_blocked" gorm:"default:false"`
+	ID        uuid.UUID     `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID    uuid.UUID     `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_contacts_user_contact"`
+	ContactID uuid.UUID     `json:"contact_id" gorm:"type:uuid;not null;uniqueIndex:idx_contacts_user_contact;index"`
+	Status    ContactStatus `json:"status" gorm:"default:'accepted';index"`
+	Nickname  string        `json:"nickname"`
+	IsBlocked bool          `json:"is_blocked" gorm:"default:false"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
@@ -54,13 +99,43 @@ type Contact struct {
 	Contact User `json:"contact" gorm:"foreignKey:ContactID"`
 }
 
+// ContactMatchUsage counts the emails and hashes a user looked up on Day.
+// It is reset by the first lookup of the next day.
+type ContactMatchUsage struct {
+	UserID uuid.UUID `gorm:"type:uuid;primary_key"`
+	Day    time.Time `gorm:"type:date;not null"`
+	Count  int       `gorm:"not null"`
+}
+
+type ClientType string
+
+const (
+	ClientTypeWeb     ClientType = "web"
+	ClientTypeDesktop ClientType = "desktop"
+	ClientTypeAndroid ClientType = "android"
+	ClientTypeIOS     ClientType = "ios"
+)
+
+// UserSession is one refresh token. Every refresh uses it up and issues the
+// next token of the same family; a family is one login on one device and
+// carries that device's details along.
 type UserSession struct {
-	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
-	Token     string    `json:"token" gorm:"not null"`
-	ExpiresAt time.Time `json:"expires_at"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	FamilyID  uuid.UUID  `json:"family_id" gorm:"type:uuid;index"`
+	// Token is the SHA-256 of the refresh token, never the token itself
+	Token      string     `json:"-" gorm:"not null;index"`
+	DeviceName string     `json:"device_name"`
+	ClientType ClientType `json:"client_type" gorm:"default:'web'"`
+	IP         string     `json:"ip"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	// Current marks the session the request was made with
+	Current bool `json:"current" gorm:"-"`
 
 	// Relationships
 	User User `json:"user" gorm:"foreignKey:UserID"`
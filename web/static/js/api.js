@@ -3,16 +3,144 @@ class ApiClient {
     constructor(baseUrl = '/api/v1') {
         this.baseUrl = baseUrl;
         this.token = localStorage.getItem('auth_token');
+        this.refreshToken = localStorage.getItem('refresh_token');
+        this.refreshing = null;
+        this.refreshTimer = null;
+
+        const expiresAt = localStorage.getItem('token_expires_at');
+        if (this.refreshToken && expiresAt) {
+            this.scheduleRefresh(expiresAt);
+        }
+
+        // Токены общие для всех вкладок: подхватываем то, что сохранила другая вкладка
+        window.addEventListener('storage', (event) => this.handleStorage(event));
     }
 
-    // Установить токен аутентификации
+    // Установить токен аутентификации; без токена сбрасывается и refresh token
     setToken(token) {
         this.token = token;
         if (token) {
             localStorage.setItem('auth_token', token);
         } else {
             localStorage.removeItem('auth_token');
+            localStorage.removeItem('refresh_token');
+            localStorage.removeItem('token_expires_at');
+            this.refreshToken = null;
+            clearTimeout(this.refreshTimer);
+        }
+    }
+
+    // Сохранить ответ login/register/refresh: { token, refresh_token, expires_at }
+    setSession({ token, refresh_token, expires_at }) {
+        this.setToken(token);
+        this.refreshToken = refresh_token;
+        localStorage.setItem('refresh_token', refresh_token);
+        localStorage.setItem('token_expires_at', expires_at);
+        this.scheduleRefresh(expires_at);
+    }
+
+    // Принять токены, которые другая вкладка уже сохранила в localStorage
+    loadStoredSession() {
+        const tokens = {
+            token: localStorage.getItem('auth_token'),
+            refresh_token: localStorage.getItem('refresh_token'),
+            expires_at: localStorage.getItem('token_expires_at'),
+        };
+        if (!tokens.token || !tokens.refresh_token) {
+            this.token = null;
+            this.refreshToken = null;
+            clearTimeout(this.refreshTimer);
+            return null;
+        }
+
+        this.token = tokens.token;
+        this.refreshToken = tokens.refresh_token;
+        this.scheduleRefresh(tokens.expires_at);
+        window.dispatchEvent(new CustomEvent('auth_token_refreshed', { detail: tokens }));
+        return tokens;
+    }
+
+    // setSession пишет token_expires_at последним, а выход удаляет auth_token первым
+    handleStorage(event) {
+        if (event.storageArea !== localStorage) {
+            return;
+        }
+        const loggedIn = event.key === 'token_expires_at' && event.newValue;
+        const loggedOut = (event.key === 'auth_token' && !event.newValue) || event.key === null;
+        if (loggedIn || loggedOut) {
+            this.loadStoredSession();
+        }
+    }
+
+    // Обновляем access token за минуту до истечения
+    scheduleRefresh(expiresAt) {
+        clearTimeout(this.refreshTimer);
+        const delay = Math.max(new Date(expiresAt).getTime() - Date.now() - 60 * 1000, 0);
+        this.refreshTimer = setTimeout(() => {
+            this.refreshSession().catch(error => {
+                console.error('Token refresh failed:', error);
+                // Временная ошибка: пробуем еще раз через 30 секунд
+                if (this.refreshToken) {
+                    this.scheduleRefresh(new Date(Date.now() + 90 * 1000));
+                }
+            });
+        }, delay);
+    }
+
+    // Обмен refresh token на новую пару. Каждый refresh token одноразовый, а
+    // повторное использование отзывает всю сессию, поэтому параллельные вызовы
+    // ждут один запрос, а вкладки обновляют токены по очереди под общей блокировкой.
+    async refreshSession() {
+        if (!this.refreshing) {
+            const used = this.refreshToken;
+            const refresh = () => this.exchangeRefreshToken(used);
+            const locked = navigator.locks
+                ? navigator.locks.request('auth_refresh', refresh)
+                : refresh();
+
+            this.refreshing = locked.finally(() => {
+                this.refreshing = null;
+            });
         }
+        return this.refreshing;
+    }
+
+    async exchangeRefreshToken(used) {
+        if (!used) {
+            throw new Error('Session expired');
+        }
+
+        // Другая вкладка уже обменяла этот токен или вышла из аккаунта
+        const stored = localStorage.getItem('refresh_token');
+        if (stored !== used) {
+            const tokens = this.loadStoredSession();
+            if (!tokens) {
+                throw new Error('Session expired');
+            }
+            return tokens;
+        }
+
+        const response = await fetch(`${this.baseUrl}/auth/refresh`, {
+            method: 'POST',
+            headers: this.getHeaders(false),
+            body: JSON.stringify({ refresh_token: used }),
+        });
+
+        // Сессию завершаем только если сервер отверг токен; 5xx и сетевые
+        // ошибки временные
+        if (response.status === 401) {
+            this.setToken(null);
+            throw new Error('Session expired');
+        }
+        if (!response.ok) {
+            throw new Error(`Token refresh failed: HTTP ${response.status}`);
+        }
+
+        const tokens = await response.json();
+        this.setSession(tokens);
+        // WebSocket передает новый токен в уже открытое соединение
+        window.dispatchEvent(new CustomEvent('auth_token_refreshed', { detail: tokens }));
+        return tokens;
     }
 
     // Получить заголовки запроса
@@ -40,6 +168,12 @@ class ApiClient {
 
         try {
             const response = await fetch(url, config);
+
+            // Истекший access token обновляем и повторяем запрос один раз
+            if (response.status === 401 && options.auth !== false && this.refreshToken && !options.retried) {
+                await this.refreshSession();
+                return this.request(endpoint, { ...options, retried: true });
+            }
             
             if (!response.ok) {
                 const error = await response.json().catch(() => ({ error: 'Network error' }));
@@ -83,17 +217,41 @@ class ApiClient {
 
     // Методы аутентификации
     async register(userData) {
-        return this.post('/auth/register', userData, { auth: false });
+        return this.post('/auth/register', { client_type: 'web', ...userData }, { auth: false });
     }
 
     async login(credentials) {
-        return this.post('/auth/login', credentials, { auth: false });
+        return this.post('/auth/login', { client_type: 'web', ...credentials }, { auth: false });
     }
 
     async logout() {
         return this.post('/auth/logout', {});
     }
 
+    // Подтверждение email и восстановление пароля
+    async verifyEmail(token) {
+        return this.post('/auth/verify-email', { token }, { auth: false });
+    }
+
+    async resendVerification() {
+        return this.post('/auth/verify-email/resend', {});
+    }
+
+    async forgotPassword(email) {
+        return this.post('/auth/password/forgot', { email }, { auth: false });
+    }
+
+    async resetPassword(token, password) {
+        return this.post('/auth/password/reset', { token, password }, { auth: false });
+    }
+
+    async changePassword(currentPassword, newPassword) {
+        return this.put('/users/me/password', {
+            current_password: currentPassword,
+            new_password: newPassword,
+        });
+    }
+
     // Методы пользователей
     async getCurrentUser() {
         const response = await this.get('/users/me');
@@ -114,6 +272,25 @@ class ApiClient {
         return this.put('/users/me', profileData);
     }
 
+    // Занятое место, квота и разбивка по типам файлов и чатам
+    async getStorageUsage() {
+        const response = await this.get('/users/me/storage');
+        return response.storage;
+    }
+
+    // Сессии (устройства, с которых выполнен вход)
+    async getSessions() {
+        return this.get('/users/me/sessions');
+    }
+
+    async revokeSession(sessionId) {
+        return this.delete(`/users/me/sessions/${sessionId}`);
+    }
+
+    async revokeOtherSessions() {
+        return this.delete('/users/me/sessions');
+    }
+
     async updateStatus(status) {
         return this.put('/users/status', { status });
     }
@@ -153,9 +330,21 @@ class ApiClient {
     }
 
     // Методы сообщений
-    async getMessages(chatId, limit = 20, offset = 0) {
-        const response = await this.get(`/messages?chat_id=${chatId}&limit=${limit}&offset=${offset}`);
-        return response.messages;
+    // Возвращает страницу истории, новые сообщения первыми.
+    // options: { limit, before, after, around } - курсор или ID сообщения
+    async getMessagePage(conversation, options = {}) {
+        const params = new URLSearchParams({ ...conversation, limit: options.limit || 50 });
+        for (const key of ['before', 'after', 'around']) {
+            if (options[key]) {
+                params.set(key, options[key]);
+            }
+        }
+        return this.get(`/messages?${params.toString()}`);
+    }
+
+    async getMessages(chatId, options = {}) {
+        const page = await this.getMessagePage({ chat_id: chatId }, options);
+        return page.messages;
     }
 
     async sendMessage(messageData) {
@@ -183,21 +372,105 @@ class ApiClient {
         return response;
     }
 
+    // Отмечает всю переписку прочитанной до messageId: { chat_id } или { receiver_id }
+    async markConversationAsRead(conversation, messageId) {
+        return this.post('/messages/read', { ...conversation, message_id: messageId });
+    }
+
+    // filters: { chat_id, receiver_id, sender_id, from, to, type, has_attachments, limit, offset }
+    async searchMessages(query, filters = {}) {
+        const params = new URLSearchParams({ q: query, ...filters });
+        return this.get(`/messages/search?${params.toString()}`);
+    }
+
+    async getUnreadCounts() {
+        return this.get('/messages/unread');
+    }
+
     // Методы контактов
     async getContacts() {
         const response = await this.get('/contacts');
         return response.contacts;
     }
 
+    // contactData: { contact_id, nickname }
     async addContact(contactData) {
         const response = await this.post('/contacts', contactData);
         return response.contact;
     }
 
+    // { incoming: [...], outgoing: [...] }
+    async getContactRequests() {
+        const response = await this.get('/contacts/requests');
+        return response.requests;
+    }
+
+    async getBlockedContacts() {
+        const response = await this.get('/contacts/blocked');
+        return response.contacts;
+    }
+
+    async updateContact(contactId, nickname) {
+        const response = await this.put(`/contacts/${contactId}`, { nickname });
+        return response.contact;
+    }
+
+    async acceptContact(contactId) {
+        const response = await this.put(`/contacts/${contactId}/accept`);
+        return response.contact;
+    }
+
+    async declineContact(contactId) {
+        return this.put(`/contacts/${contactId}/decline`);
+    }
+
     async removeContact(contactId) {
         return this.delete(`/contacts/${contactId}`);
     }
 
+    // Поиск пользователей по email или хешам email (hex SHA-256 от email в нижнем
+    // регистре); add: true сразу отправляет найденным заявки в контакты
+    async matchContacts({ emails = [], hashes = [], add = false }) {
+        const response = await this.post('/contacts/match', { emails, hashes, add });
+        return response.matches;
+    }
+
+    // Импорт файла vCard: { cards, matches, unmatched }
+    async importContacts(file) {
+        const formData = new FormData();
+        formData.append('file', file);
+
+        const response = await fetch(`${this.baseUrl}/contacts/import`, {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${this.token}`,
+            },
+            body: formData,
+        });
+
+        if (!response.ok) {
+            const error = await response.json().catch(() => ({ error: 'Import failed' }));
+            throw new Error(error.error || `HTTP ${response.status}`);
+        }
+
+        return await response.json();
+    }
+
+    // Экспорт контактов в vCard, возвращает Blob
+    async exportContacts() {
+        const response = await fetch(`${this.baseUrl}/contacts/export`, {
+            headers: {
+                'Authorization': `Bearer ${this.token}`,
+            },
+        });
+
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
+
+        return await response.blob();
+    }
+
     async blockContact(contactId) {
         return this.put(`/contacts/${contactId}/block`);
     }
@@ -207,8 +480,10 @@ class ApiClient {
     }
 
     // Методы звонков
-    async getCalls() {
-        return this.get('/calls');
+    // filters: { type, status, limit, offset }
+    async getCalls(filters = {}) {
+        const params = new URLSearchParams(filters);
+        return this.get(`/calls?${params.toString()}`);
     }
 
     async initiateCall(callData) {
@@ -223,8 +498,54 @@ class ApiClient {
         return this.put(`/calls/${callId}/reject`);
     }
 
-    async endCall(callId) {
-        return this.put(`/calls/${callId}/end`);
+    async endCall(callId, failed = false) {
+        return this.put(`/calls/${callId}/end`, { failed });
+    }
+
+    // { ice_servers, expires_at } для new RTCPeerConnection({ iceServers })
+    async getIceServers() {
+        return this.get('/calls/ice-servers');
+    }
+
+    async setScreenShare(callId, enabled) {
+        return this.put(`/calls/${callId}/screen-share`, { enabled });
+    }
+
+    async getCallSettings() {
+        const response = await this.get('/users/me/call-settings');
+        return response.settings;
+    }
+
+    // settings: { allow_voice_calls, allow_video_calls, allow_screen_share, auto_answer, ringtone_path, call_quality }
+    async updateCallSettings(settings) {
+        const response = await this.put('/users/me/call-settings', settings);
+        return response.settings;
+    }
+
+    // Групповые звонки
+    async startGroupCall(chatId, type = 'voice') {
+        return this.post('/calls/group', { chat_id: chatId, type });
+    }
+
+    async joinCall(callId) {
+        return this.put(`/calls/${callId}/join`);
+    }
+
+    async leaveCall(callId) {
+        return this.put(`/calls/${callId}/leave`);
+    }
+
+    // media: { is_muted, is_video_on }
+    async updateCallMedia(callId, media) {
+        return this.put(`/calls/${callId}/media`, media);
+    }
+
+    async muteCallParticipant(callId, userId) {
+        return this.put(`/calls/${callId}/participants/${userId}/mute`);
+    }
+
+    async removeCallParticipant(callId, userId) {
+        return this.delete(`/calls/${callId}/participants/${userId}`);
     }
 
     // Загрузка файлов
@@ -249,6 +570,47 @@ class ApiClient {
         return await response.json();
     }
 
+    // Загрузка больших файлов частями с докачкой после обрыва.
+    // target: { chat_id } | { receiver_id } | { message_id }, можно добавить content
+    async uploadFileResumable(file, target, onProgress, chunkSize = 8 * 1024 * 1024) {
+        const { session } = await this.post('/uploads', {
+            ...target,
+            file_name: file.name,
+            file_size: file.size,
+        });
+
+        let offset = session.offset;
+        while (offset < file.size) {
+            const response = await fetch(`${this.baseUrl}/uploads/${session.id}`, {
+                method: 'PATCH',
+                headers: {
+                    'Authorization': `Bearer ${this.token}`,
+                    'Content-Type': 'application/offset+octet-stream',
+                    'Upload-Offset': String(offset),
+                },
+                body: file.slice(offset, offset + chunkSize),
+            });
+
+            if (!response.ok && response.status !== 409) {
+                const error = await response.json().catch(() => ({ error: 'Upload failed' }));
+                throw new Error(error.error || `HTTP ${response.status}`);
+            }
+
+            // При 409 сервер сообщает, с какого места продолжать
+            offset = parseInt(response.headers.get('Upload-Offset'), 10);
+            if (onProgress) {
+                onProgress(offset, file.size);
+            }
+        }
+
+        return this.post(`/uploads/${session.id}/complete`, {});
+    }
+
+    // Подписанная ссылка на файл для <img>/<video> без заголовка Authorization
+    async getFileUrl(fileId) {
+        return this.post(`/files/${fileId}/url`, {});
+    }
+
     // Проверка health
     async checkHealth() {
         try {
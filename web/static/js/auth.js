@@ -5,8 +5,29 @@ class AuthManager {
         this.registerForm = document.getElementById('registerForm');
         this.loginFormDiv = document.getElementById('login-form');
         this.registerFormDiv = document.getElementById('register-form');
+        this.forgotForm = document.getElementById('forgotForm');
+        this.resetForm = document.getElementById('resetForm');
+        this.forgotFormDiv = document.getElementById('forgot-form');
+        this.resetFormDiv = document.getElementById('reset-form');
         
         this.initializeEventListeners();
+
+        // Ссылки из писем: подтверждение email и сброс пароля
+        const params = new URLSearchParams(window.location.search);
+        this.resetToken = params.get('reset_token');
+        const verifyToken = params.get('verify_token');
+        if (this.resetToken || verifyToken) {
+            window.history.replaceState(null, '', window.location.pathname);
+        }
+
+        if (this.resetToken) {
+            this.showForm(this.resetFormDiv);
+            return;
+        }
+        if (verifyToken) {
+            this.handleVerifyEmail(verifyToken).then(() => this.checkAuthStatus());
+            return;
+        }
         this.checkAuthStatus();
     }
 
@@ -33,6 +54,28 @@ class AuthManager {
             this.handleRegister();
         });
 
+        document.getElementById('show-forgot').addEventListener('click', (e) => {
+            e.preventDefault();
+            this.showForm(this.forgotFormDiv);
+        });
+
+        document.querySelectorAll('.show-login').forEach(link => {
+            link.addEventListener('click', (e) => {
+                e.preventDefault();
+                this.showLoginForm();
+            });
+        });
+
+        this.forgotForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.handleForgotPassword();
+        });
+
+        this.resetForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.handleResetPassword();
+        });
+
         // Валидация в реальном времени
         this.setupFormValidation();
     }
@@ -118,21 +161,26 @@ class AuthManager {
     }
 
     showLoginForm() {
-        this.registerFormDiv.classList.remove('active');
-        this.loginFormDiv.classList.add('active');
-        
+        this.showForm(this.loginFormDiv);
+    }
+
+    // Показывает одну из форм и очищает остальные
+    showForm(formDiv) {
+        document.querySelectorAll('.auth-form').forEach(div => {
+            div.classList.toggle('active', div === formDiv);
+        });
+
         // Очистка форм
         this.clearFormErrors();
-        this.registerForm.reset();
+        document.querySelectorAll('.auth-form form').forEach(form => {
+            if (!formDiv.contains(form)) {
+                form.reset();
+            }
+        });
     }
 
     showRegisterForm() {
-        this.loginFormDiv.classList.remove('active');
-        this.registerFormDiv.classList.add('active');
-        
-        // Очистка форм
-        this.clearFormErrors();
-        this.loginForm.reset();
+        this.showForm(this.registerFormDiv);
     }
 
     clearFormErrors() {
@@ -165,7 +213,7 @@ class AuthManager {
             const response = await api.login(credentials);
             
             // Сохранение токена
-            api.setToken(response.token);
+            api.setSession(response);
             
             // Сохранение информации о пользователе
             localStorage.setItem('user_info', JSON.stringify(response.user));
@@ -206,7 +254,7 @@ class AuthManager {
             const response = await api.register(userData);
             
             // Сохранение токена
-            api.setToken(response.token);
+            api.setSession(response);
             
             // Сохранение информации о пользователе
             localStorage.setItem('user_info', JSON.stringify(response.user));
@@ -225,6 +273,61 @@ class AuthManager {
         }
     }
 
+    async handleForgotPassword() {
+        if (!this.validateForm(this.forgotForm)) {
+            return;
+        }
+
+        const email = new FormData(this.forgotForm).get('email');
+        const submitBtn = this.forgotForm.querySelector('button[type="submit"]');
+        this.setButtonLoading(submitBtn, true);
+
+        try {
+            await api.forgotPassword(email);
+            notifications.success('Письмо отправлено', 'Если такой email зарегистрирован, на него придет ссылка для сброса пароля');
+            this.showLoginForm();
+        } catch (error) {
+            notifications.error('Ошибка', error.message);
+        } finally {
+            this.setButtonLoading(submitBtn, false);
+        }
+    }
+
+    async handleResetPassword() {
+        if (!this.validateForm(this.resetForm)) {
+            return;
+        }
+
+        const password = new FormData(this.resetForm).get('password');
+        const submitBtn = this.resetForm.querySelector('button[type="submit"]');
+        this.setButtonLoading(submitBtn, true);
+
+        try {
+            await api.resetPassword(this.resetToken, password);
+            this.resetToken = null;
+
+            // Сброс пароля завершает все сессии, входим заново
+            localStorage.removeItem('user_info');
+            api.setToken(null);
+
+            notifications.success('Пароль изменен', 'Войдите с новым паролем');
+            this.showLoginForm();
+        } catch (error) {
+            notifications.error('Ошибка сброса пароля', error.message);
+        } finally {
+            this.setButtonLoading(submitBtn, false);
+        }
+    }
+
+    async handleVerifyEmail(token) {
+        try {
+            await api.verifyEmail(token);
+            notifications.success('Email подтвержден', 'Спасибо! Ваш адрес подтвержден');
+        } catch (error) {
+            notifications.error('Ошибка подтверждения', error.message);
+        }
+    }
+
     validateForm(form) {
         const inputs = form.querySelectorAll('input[required]');
         let isValid = true;
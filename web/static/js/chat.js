@@ -357,7 +357,8 @@ class ChatController {
             console.log('Loading messages for chat:', chatId);
             const messages = await api.getMessages(chatId);
             console.log('Messages response:', messages);
-            this.renderMessages(messages || []);
+            // API отдает новые сообщения первыми, а показываем мы их сверху вниз
+            this.renderMessages((messages || []).slice().reverse());
         } catch (error) {
             console.error('Failed to load messages:', error);
             notifications.error('Ошибка', 'Не удалось загрузить сообщения');
@@ -678,7 +679,8 @@ class ChatController {
         notifications.info('Звонок', `Инициирую ${type === 'voice' ? 'голосовой' : 'видео'} звонок`);
         
         // TODO: Implement call functionality
-        // this.websocket.sendCallOffer(targetUserId, type, offer);
+        // const { call } = await api.initiateCall({ callee_id: targetUserId, type });
+        // this.websocket.sendCallOffer(call.id, offer);
     }
 
     handleCallOffer(data) {
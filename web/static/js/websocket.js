@@ -8,6 +8,18 @@ class WebSocketClient {
         this.isConnected = false;
         this.messageQueue = [];
         this.eventHandlers = new Map();
+
+        // Состояние потока для возобновления сессии после переподключения
+        this.streamId = null;
+        this.lastSeq = 0;
+        this.lastEventTime = null;
+
+        // Обновленный access token продлевает открытое соединение без переподключения
+        window.addEventListener('auth_token_refreshed', (event) => {
+            if (this.isConnected) {
+                this.send('auth', { token: event.detail.token });
+            }
+        });
         
         this.connect();
     }
@@ -20,7 +32,13 @@ class WebSocketClient {
         }
 
         const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${window.location.host}/ws?token=${token}`;
+        let wsUrl = `${protocol}//${window.location.host}/ws?token=${token}&protocol=2`;
+        if (this.streamId) {
+            wsUrl += `&stream_id=${this.streamId}&last_seq=${this.lastSeq}`;
+            if (this.lastEventTime) {
+                wsUrl += `&since=${this.lastEventTime}`;
+            }
+        }
 
         try {
             this.ws = new WebSocket(wsUrl);
@@ -45,11 +63,21 @@ class WebSocketClient {
         };
 
         this.ws.onmessage = (event) => {
-            try {
-                const message = JSON.parse(event.data);
-                this.handleMessage(message);
-            } catch (error) {
-                console.error('Error parsing WebSocket message:', error);
+            // Сервер может склеить несколько сообщений в один кадр через перевод строки
+            const ackBefore = this.lastSeq;
+            event.data.split('\n').forEach(line => {
+                if (!line.trim()) return;
+                try {
+                    const message = JSON.parse(line);
+                    this.handleMessage(message);
+                } catch (error) {
+                    console.error('Error parsing WebSocket message:', error);
+                }
+            });
+
+            // Подтверждаем получение, чтобы сервер не хранил события для повтора
+            if (this.lastSeq > ackBefore) {
+                this.send('ack', { seq: this.lastSeq });
             }
         };
 
@@ -58,6 +86,14 @@ class WebSocketClient {
             this.isConnected = false;
             this.emit('disconnected');
             
+            // 4001 - истек access token: обновляем его и подключаемся заново
+            if (event.code === 4001 && window.api) {
+                window.api.refreshSession()
+                    .then(() => this.connect())
+                    .catch(error => console.error('Token refresh failed:', error));
+                return;
+            }
+
             // Переподключение только если это не преднамеренное закрытие
             if (!event.wasClean) {
                 this.scheduleReconnect();
@@ -72,9 +108,35 @@ class WebSocketClient {
 
     handleMessage(message) {
         console.log('WebSocket message received:', message);
-        const { type, data, user_id, timestamp } = message;
+        const { type, seq, data, user_id, timestamp } = message;
+
+        if (seq) {
+            // Пропускаем повторно доставленные события
+            if (seq <= this.lastSeq) return;
+            this.lastSeq = seq;
+            this.lastEventTime = timestamp;
+        }
         
         switch (type) {
+            case 'error':
+                console.warn('WebSocket request rejected:', data);
+                this.emit('error_frame', { ...data, correlation_id: message.correlation_id });
+                break;
+
+            case 'result':
+                this.emit('result', { ...data, correlation_id: message.correlation_id });
+                break;
+
+            case 'session':
+                // Если буфер не покрыл разрыв, нумерация начинается с текущей позиции сервера
+                if (data.resume !== 'buffer') {
+                    this.lastSeq = data.last_seq;
+                }
+                this.streamId = data.stream_id;
+                this.emit('session', data);
+                break;
+                
+
             case 'chat':
                 console.log('Chat message:', data);
                 this.emit('message', { ...data, user_id, timestamp });
@@ -105,6 +167,24 @@ class WebSocketClient {
             case 'call_end':
                 this.emit('call_end', { ...data, user_id });
                 break;
+
+            case 'ice_candidate':
+                this.emit('ice_candidate', { ...data, user_id });
+                break;
+
+            case 'call_renegotiate':
+                this.emit('call_renegotiate', { ...data, user_id });
+                break;
+
+            // Смена состояния звонка: ringing, active, ended, missed, declined, failed
+            case 'call_updated':
+                this.emit('call_updated', data);
+                break;
+
+            // Микрофон и камера участника группового звонка
+            case 'call_participant_updated':
+                this.emit('call_participant_updated', data);
+                break;
                 
             case 'new_message':
                 console.log('New message:', data);
@@ -114,6 +194,40 @@ class WebSocketClient {
             case 'message_read':
                 this.emit('message_read', { ...data, user_id });
                 break;
+
+            case 'message_delivered':
+                this.emit('message_delivered', { ...data, user_id });
+                break;
+
+            case 'messages_read':
+                this.emit('messages_read', { ...data, user_id });
+                break;
+
+            case 'unread_count':
+                this.emit('unread_count', data);
+                break;
+                
+            // Заявки в контакты: новая заявка, принятие, удаление из контактов
+            case 'contact_request':
+                this.emit('contact_request', data);
+                break;
+
+            case 'contact_accepted':
+                this.emit('contact_accepted', data);
+                break;
+
+            case 'contact_removed':
+                this.emit('contact_removed', data);
+                break;
+                
+            // Сессию этого устройства завершили с другого устройства:
+            // сервер закроет соединение, выходим из аккаунта
+            case 'session_revoked':
+                this.emit('session_revoked', data);
+                if (window.AuthManager) {
+                    window.AuthManager.logout();
+                }
+                break;
                 
             case 'user_joined':
                 this.emit('user_joined', { ...data, user_id });
@@ -182,31 +296,39 @@ class WebSocketClient {
         });
     }
 
-    sendCallOffer(targetUserId, callType, offer) {
-        this.send('call_offer', {
-            target_user_id: targetUserId,
-            call_type: callType,
-            offer
-        });
+    // Сигнализация звонка: callId - звонок, созданный через POST /calls.
+    // Без targetUserId кадр получают все остальные участники звонка.
+    sendCallOffer(callId, offer, targetUserId = null) {
+        this.sendCallSignal('call_offer', callId, { offer }, targetUserId);
     }
 
-    sendCallAnswer(targetUserId, answer) {
-        this.send('call_answer', {
-            target_user_id: targetUserId,
-            answer
-        });
+    sendCallAnswer(callId, answer, targetUserId = null) {
+        this.sendCallSignal('call_answer', callId, { answer }, targetUserId);
     }
 
-    sendCallReject(targetUserId) {
-        this.send('call_reject', {
-            target_user_id: targetUserId
-        });
+    sendIceCandidate(callId, candidate, targetUserId = null) {
+        this.sendCallSignal('ice_candidate', callId, { candidate }, targetUserId);
     }
 
-    sendCallEnd(targetUserId) {
-        this.send('call_end', {
-            target_user_id: targetUserId
-        });
+    // description: { offer } или { answer }
+    sendCallRenegotiate(callId, description, targetUserId = null) {
+        this.sendCallSignal('call_renegotiate', callId, description, targetUserId);
+    }
+
+    sendCallReject(callId) {
+        this.sendCallSignal('call_reject', callId, {});
+    }
+
+    sendCallEnd(callId) {
+        this.sendCallSignal('call_end', callId, {});
+    }
+
+    sendCallSignal(type, callId, data, targetUserId = null) {
+        const payload = { call_id: callId, ...data };
+        if (targetUserId) {
+            payload.target_user_id = targetUserId;
+        }
+        this.send(type, payload);
     }
 
     markMessageAsRead(messageId) {